@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tokenRequest is the body of a request to mint a token.
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// tokensHandler is the request handler for /api/tokens and /api/tokens/{id}
+// it lists and mints the user's tokens on /api/tokens and revokes
+// them on /api/tokens/{id}. Admins can see and revoke all the tokens.
+func (cmd *serverCommand) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := cmd.authenticate(r, scopeAdmin)
+	if !ok {
+		writeUnauthorized(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	owner := u.name
+	if u.admin {
+		owner = ""
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+
+	switch {
+	case len(id) < 1 && r.Method == "GET":
+		if err := json.NewEncoder(w).Encode(cmd.tokens.list(owner)); err != nil {
+			logrus.Warnf("writing tokens failed: %v", err)
+		}
+	case len(id) < 1 && r.Method == "POST":
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("parsing body as json failed: %v", err))
+			return
+		}
+		if len(req.Scopes) < 1 {
+			writeErrorStatus(w, http.StatusBadRequest, "a token needs at least one scope")
+			return
+		}
+		for _, s := range req.Scopes {
+			if !validScope(s) {
+				writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("unknown scope %q", s))
+				return
+			}
+			if s == scopeAdmin && !u.admin {
+				writeErrorStatus(w, http.StatusForbidden, "only admins can create admin tokens")
+				return
+			}
+		}
+
+		t, secret, err := cmd.tokens.create(u.name, req.Name, req.Scopes)
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("creating token failed: %v", err))
+			return
+		}
+		fmt.Fprint(w, JSONResponse{
+			"id":    t.ID,
+			"token": secret,
+		})
+		logrus.Infof("token %q created for %s", t.ID, u.name)
+	case len(id) > 0 && r.Method == "DELETE":
+		if err := cmd.tokens.revoke(id, owner); err != nil {
+			writeErrorStatus(w, http.StatusNotFound, err.Error())
+			return
+		}
+		fmt.Fprint(w, JSONResponse{
+			"id": id,
+		})
+		logrus.Infof("token %q revoked by %s", id, u.name)
+	default:
+		writeErrorStatus(w, http.StatusMethodNotAllowed, "not a valid endpoint")
+	}
+}
+
+// pasteUpdate is the body of a request to update a paste.
+type pasteUpdate struct {
+	Visibility string `json:"visibility"`
+}
+
+// pastesHandler is the request handler for /api/pastes/{id}
+// it returns the metadata of the paste on GET and updates it on PATCH.
+// Only the owner of the paste and admins can use it.
+func (cmd *serverCommand) pastesHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := cmd.authenticate(r, scopeAdmin)
+	if !ok {
+		writeUnauthorized(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/pastes"), "/")
+	if !validID(id) {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("No such paste: %s", id))
+		return
+	}
+	meta, err := cmd.store.Stat(id)
+	if err == errPasteNotFound || (err == nil && !u.canSee(meta)) {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("No such paste: %s", id))
+		return
+	}
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("getting paste %s failed: %v", id, err))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		var update pasteUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("parsing body as json failed: %v", err))
+			return
+		}
+		if len(update.Visibility) > 0 {
+			if !validVisibility(update.Visibility) {
+				writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("unknown visibility %q", update.Visibility))
+				return
+			}
+			meta.Visibility = update.Visibility
+		}
+		if err := cmd.store.SetMetadata(meta); err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("updating paste %s failed: %v", id, err))
+			return
+		}
+		logrus.Infof("paste %q updated by %s", id, u.name)
+	default:
+		writeErrorStatus(w, http.StatusMethodNotAllowed, "not a valid endpoint")
+		return
+	}
+
+	// never hand out the password hash
+	resp := *meta
+	resp.PasswordHash = ""
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.Warnf("writing paste %s failed: %v", id, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes the contents of r to the file at path through a
+// temporary file in the same directory that is synced and renamed over it,
+// so a crash never leaves the file partially written.
+func writeFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tmp, err := writeTemp(path, r, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// createFileAtomic is like writeFileAtomic, but the temporary file is
+// linked to path instead of renamed over it, so it fails with an error
+// satisfying os.IsExist rather than replacing a file that exists.
+func createFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tmp, err := writeTemp(path, r, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeTemp writes the contents of r to a synced temporary file next to
+// path and returns its name. The temporary file is a dotfile so it is not
+// mistaken for a paste. The caller must remove it.
+func writeTemp(path string, r io.Reader, perm os.FileMode) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	err = func() error {
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return fmt.Errorf("writing file to %q failed: %v", path, err)
+		}
+		if err := tmp.Chmod(perm); err != nil {
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			return fmt.Errorf("syncing file %q failed: %v", path, err)
+		}
+		return tmp.Close()
+	}()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// syncDir syncs the directory so the renames in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeBytesAtomic is writeFileAtomic for contents already in memory.
+func writeBytesAtomic(path string, b []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, bytes.NewReader(b), perm)
+}
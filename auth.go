@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// authModeAll needs auth for the index and uploads.
+	authModeAll = "all"
+	// authModeWrites only needs auth for uploads.
+	authModeWrites = "writes"
+)
+
+// user is an account that can authenticate with the server.
+type user struct {
+	name  string
+	hash  []byte
+	admin bool
+}
+
+// checkPassword returns whether the password is the user's password.
+func (u *user) checkPassword(password string) bool {
+	if u.hash == nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(u.hash, []byte(password)) == nil
+}
+
+// canSee returns whether the user can see the paste in the index.
+// A nil user is anonymous.
+func (u *user) canSee(meta *Metadata) bool {
+	if u == nil {
+		return meta.Visibility == "" || meta.Visibility == visibilityPublic
+	}
+	return u.admin || meta.Owner == u.name
+}
+
+// loadUsers reads the users from an htpasswd style file with a
+// name:bcrypt-hash line per user. Users with a third :admin field
+// are admins.
+func loadUsers(path string) (map[string]*user, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening users file %q failed: %v", path, err)
+	}
+	defer f.Close()
+
+	users := map[string]*user{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || len(fields[0]) < 1 {
+			return nil, fmt.Errorf("%s:%d: expected name:hash[:admin]", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: password for %s is not a bcrypt hash: %v", path, n, fields[0], err)
+		}
+
+		u := &user{
+			name: fields[0],
+			hash: []byte(fields[1]),
+		}
+		if len(fields) == 3 {
+			if fields[2] != "admin" {
+				return nil, fmt.Errorf("%s:%d: unknown role %q", path, n, fields[2])
+			}
+			u.admin = true
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading users file %q failed: %v", path, err)
+	}
+
+	return users, nil
+}
+
+// envUsers returns the admin user from the <prefix>_USERNAME and
+// <prefix>_PASSWORD environment variables.
+func envUsers(prefix string) (map[string]*user, error) {
+	name := os.Getenv(prefix + "_USERNAME")
+	pass := os.Getenv(prefix + "_PASSWORD")
+	if len(name) < 1 || len(pass) < 1 {
+		return nil, fmt.Errorf("%s_USERNAME and %s_PASSWORD must be set when there is no --auth-file", prefix, prefix)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*user{
+		name: {name: name, hash: hash, admin: true},
+	}, nil
+}
+
+// authenticate returns the user for the basic auth credentials or the
+// bearer token of the request, or false if they are missing or wrong.
+// Bearer tokens also need to have the scope.
+func (cmd *serverCommand) authenticate(r *http.Request, scope string) (*user, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		t, ok := cmd.tokens.lookup(strings.TrimPrefix(auth, "Bearer "))
+		if !ok || !t.hasScope(scope) {
+			return nil, false
+		}
+		owner, ok := cmd.lookupUser(t.Owner)
+		if !ok {
+			return nil, false
+		}
+		// Only admin tokens get the admin powers of their owner.
+		return &user{name: owner.name, admin: owner.admin && t.hasScope(scopeAdmin)}, true
+	}
+
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+
+	u, ok := cmd.users[name]
+	if !ok || !u.checkPassword(pass) {
+		return nil, false
+	}
+	return u, true
+}
+
+// lookupUser returns the user with the name.
+func (cmd *serverCommand) lookupUser(name string) (*user, bool) {
+	u, ok := cmd.users[name]
+	return u, ok
+}
+
+// hasCredentials returns whether the request carries any credentials.
+func hasCredentials(r *http.Request) bool {
+	return len(r.Header.Get("Authorization")) > 0
+}
+
+// writeUnauthorized asks the requester to authenticate.
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+baseuri+`"`)
+	w.WriteHeader(401)
+	w.Write([]byte("401 Unauthorized\n"))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	file := "# users\n\nalice:" + string(hash) + "\n  bob:" + string(hash) + ":admin  \n"
+	if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := loadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] == nil || users["bob"] == nil {
+		t.Fatalf("loaded %d users, expected alice and bob", len(users))
+	}
+	if users["alice"].admin || !users["bob"].admin {
+		t.Fatal("only bob should be an admin")
+	}
+	if !users["alice"].checkPassword("secret") || users["alice"].checkPassword("wrong") {
+		t.Fatal("alice's password is not checked against her hash")
+	}
+
+	for _, line := range []string{
+		"alice",
+		"alice:" + string(hash) + ":root",
+		"alice:hunter2",
+		":" + string(hash),
+		"alice:" + string(hash) + ":admin:more",
+	} {
+		if err := ioutil.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadUsers(path); err == nil {
+			t.Fatalf("loading the users file %q did not fail", line)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		mode   string
+		user   string
+		pass   string
+		upload int
+		index  int
+	}{
+		{authModeAll, "alice", "alice", http.StatusOK, http.StatusOK},
+		{authModeAll, "alice", "wrong", http.StatusUnauthorized, http.StatusUnauthorized},
+		{authModeAll, "mallory", "mallory", http.StatusUnauthorized, http.StatusUnauthorized},
+		{authModeAll, "", "", http.StatusUnauthorized, http.StatusUnauthorized},
+		{authModeWrites, "", "", http.StatusUnauthorized, http.StatusOK},
+		{authModeWrites, "alice", "wrong", http.StatusUnauthorized, http.StatusUnauthorized},
+	} {
+		t.Run(tc.mode+"/"+tc.user+":"+tc.pass, func(t *testing.T) {
+			_, srv := newTestServer(t, func(cmd *serverCommand) { cmd.authMode = tc.mode })
+
+			for _, req := range []struct {
+				method string
+				path   string
+				status int
+			}{
+				{"POST", "/paste", tc.upload},
+				{"GET", "/", tc.index},
+			} {
+				r := newTestRequest(t, req.method, srv.URL+req.path, "", strings.NewReader("paste"))
+				if len(tc.user) > 0 {
+					r.SetBasicAuth(tc.user, tc.pass)
+				}
+				if resp, body := doTestRequest(t, r); resp.StatusCode != req.status {
+					t.Fatalf("%s %s returned %s, expected %d: %s", req.method, req.path, resp.Status, req.status, body)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadOwner(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	for _, name := range []string{"alice", "bob"} {
+		id := postTestPaste(t, srv, name, "", "paste of "+name)
+		meta, err := cmd.store.Stat(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Owner != name {
+			t.Fatalf("paste uploaded by %s is owned by %q", name, meta.Owner)
+		}
+	}
+
+	// each user only sees their own pastes in the index,
+	// and admins see all of them
+	for name, owners := range map[string][]string{
+		"alice": {"alice"},
+		"bob":   {"bob"},
+		"admin": {"alice", "bob"},
+	} {
+		_, index := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/", name, nil))
+		for _, owner := range []string{"alice", "bob"} {
+			listed := strings.Contains(index, "<td>"+owner+"</td>")
+			if listed != (len(owners) == 2 || owners[0] == owner) {
+				t.Fatalf("index of %s lists the pastes of %s: %v, expected those of %v:\n%s", name, owner, listed, owners, index)
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// burnConfirmHTML is the interstitial shown before a burn after reading
+// paste is viewed in a browser, so link previews do not burn it.
+const burnConfirmHTML = `
+<form method="post">
+<p>This paste will be deleted as soon as it is viewed.</p>
+<button type="submit">View paste</button>
+</form>
+`
+
+// burn deletes the burn after reading paste once it is being served.
+// Only the first caller gets a nil error, all others get errPasteNotFound,
+// as the stores only let one of the deletes of a paste through, even
+// across servers.
+func (cmd *serverCommand) burn(id string) error {
+	return cmd.store.Delete(id)
+}
+
+// writeBurnConfirm writes the interstitial for the burn after reading paste.
+func writeBurnConfirm(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "%s%s%s", htmlBegin, burnConfirmHTML, htmlEnd)
+}
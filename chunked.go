@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// chunkedUploadThreshold is the size above which pastes are sent
+	// as a resumable upload.
+	chunkedUploadThreshold = 16 << 20
+	// uploadChunkSize is the size of the chunks of a resumable upload.
+	uploadChunkSize = 4 << 20
+	// uploadRetries is how many times a failed request of a resumable
+	// upload is retried.
+	uploadRetries = 5
+)
+
+// postChunked sends the paste content to the server as a resumable
+// upload and returns the paste URI. Chunks that fail to send are resent
+// from where the server got to.
+func postChunked(content io.Reader) (string, error) {
+	// compress the paste as a whole, as it is sent
+	encoding := ""
+	if len(compress) > 0 && compress != compressionNone {
+		cr := compressReader(content, compress)
+		defer cr.Close()
+		content, encoding = cr, compress
+	}
+
+	// create the upload
+	resp, err := doRetry(func() (*http.Request, error) {
+		req, err := newPasteRequest("POST", baseuri+"paste/uploads?"+pasteQuery().Encode(), nil)
+		if err == nil && len(encoding) > 0 {
+			req.Header.Set(uploadEncodingHeader, encoding)
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", err
+	}
+	response, err := readPasteResponse(resp)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	uploadURI, ok := response["uri"]
+	if !ok {
+		return "", fmt.Errorf("what the hell did we get back even? %v", response)
+	}
+	logrus.Debugf("uploading paste in chunks to %s", uploadURI)
+
+	// send the chunks
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(content, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			cancelUpload(uploadURI)
+			return "", fmt.Errorf("reading paste failed: %v", err)
+		}
+		if offset, err = sendChunk(uploadURI, offset, buf[:n]); err != nil {
+			cancelUpload(uploadURI)
+			return "", err
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	// finish the upload, which is safe to retry
+	resp, err = doRetry(func() (*http.Request, error) {
+		return newPasteRequest("POST", uploadURI, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	response, err = readPasteResponse(resp)
+	if err != nil {
+		return "", err
+	}
+	pasteURI, ok := response["uri"]
+	if !ok {
+		return "", fmt.Errorf("what the hell did we get back even? %v", response)
+	}
+	return pasteURI, nil
+}
+
+// sendChunk sends the chunk starting at offset, resending whatever the
+// server did not get if it fails, and returns the offset after it.
+func sendChunk(uploadURI string, offset int64, chunk []byte) (int64, error) {
+	start, end := offset, offset+int64(len(chunk))
+	client := &http.Client{}
+
+	for attempt := 0; ; attempt++ {
+		req, err := newPasteRequest("PATCH", uploadURI, bytes.NewReader(chunk[offset-start:]))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+
+		resp, err := client.Do(req)
+		if err == nil {
+			switch {
+			case resp.StatusCode == http.StatusNoContent:
+				resp.Body.Close()
+				return end, nil
+			case resp.StatusCode == http.StatusConflict || resp.StatusCode >= 500:
+				err = fmt.Errorf("server responded with %s", resp.Status)
+				resp.Body.Close()
+			default:
+				_, err := readPasteResponse(resp)
+				resp.Body.Close()
+				if err == nil {
+					err = fmt.Errorf("server responded with %s", resp.Status)
+				}
+				return 0, err
+			}
+		}
+
+		if attempt == uploadRetries {
+			return 0, fmt.Errorf("uploading chunk at offset %d failed: %v", offset, err)
+		}
+		logrus.Warnf("uploading chunk at offset %d failed, retrying: %v", offset, err)
+		time.Sleep(backoff(attempt))
+
+		// carry on from wherever the server got to
+		cur, err := uploadOffset(uploadURI)
+		if err != nil {
+			return 0, err
+		}
+		if cur < start || cur > end {
+			return 0, fmt.Errorf("upload is at offset %d which is outside of the chunk at %d-%d", cur, start, end)
+		}
+		offset = cur
+	}
+}
+
+// uploadOffset asks the server for the offset of the upload.
+func uploadOffset(uploadURI string) (int64, error) {
+	resp, err := doRetry(func() (*http.Request, error) {
+		return newPasteRequest("HEAD", uploadURI, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("getting the offset of the upload failed: %s", resp.Status)
+	}
+	return strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+}
+
+// cancelUpload tries to delete the upload from the server, rather
+// than leaving it for the server to clean up.
+func cancelUpload(uploadURI string) {
+	req, err := newPasteRequest("DELETE", uploadURI, nil)
+	if err != nil {
+		return
+	}
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		logrus.Debugf("cancelling upload failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// doRetry does the request made by newReq, retrying network errors
+// and server errors with a backoff.
+func doRetry(newReq func() (*http.Request, error)) (*http.Response, error) {
+	client := &http.Client{}
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("server responded with %s", resp.Status)
+		}
+
+		if attempt == uploadRetries {
+			return nil, fmt.Errorf("request to %s failed: %v", req.URL, err)
+		}
+		logrus.Warnf("request to %s failed, retrying: %v", req.URL, err)
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// backoff returns how long to wait before the retry after the attempt.
+func backoff(attempt int) time.Duration {
+	return time.Duration(1<<uint(attempt)) * time.Second
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// cutOffHandler cuts off the body of the first PATCH after half of it,
+// answering with a server error like a proxy that lost the connection.
+type cutOffHandler struct {
+	http.Handler
+
+	mu  sync.Mutex
+	cut bool
+}
+
+func (h *cutOffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	cut := r.Method == "PATCH" && !h.cut
+	h.cut = h.cut || cut
+	h.mu.Unlock()
+	if !cut {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(r.Body, r.ContentLength/2), errReader{}), r.Body}
+	h.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection lost") }
+
+// setTestClient points the client at the server as the user,
+// with the compression, until the test is over.
+func setTestClient(t *testing.T, srv *httptest.Server, user, compression string) {
+	oldBaseuri, oldUsername, oldPassword, oldCompress := baseuri, username, password, compress
+	baseuri, username, password, compress = srv.URL+"/", user, user, compression
+	t.Cleanup(func() {
+		baseuri, username, password, compress = oldBaseuri, oldUsername, oldPassword, oldCompress
+	})
+}
+
+func TestPostChunked(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", uploadChunkSize/16*2+100)
+
+	for _, compression := range []string{"", compressionGzip, compressionZstd} {
+		t.Run("compression "+compression, func(t *testing.T) {
+			cmd, _ := newTestServer(t, nil)
+			h := &cutOffHandler{Handler: cmd.handler()}
+			srv := httptest.NewServer(h)
+			t.Cleanup(srv.Close)
+			setTestClient(t, srv, "alice", compression)
+
+			uri, err := postChunked(strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readPaste(t, cmd.store, path.Base(uri)); got != content {
+				t.Fatalf("paste is %d bytes, expected the %d bytes sent", len(got), len(content))
+			}
+			if !h.cut {
+				t.Fatal("no chunk was cut off")
+			}
+		})
+	}
+}
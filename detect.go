@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+// detectSize is how much of the start of a paste its language
+// is detected from.
+const detectSize = 8 << 10
+
+var (
+	// vimModeline matches vim modelines like "vim: set ft=python:".
+	vimModeline = regexp.MustCompile(`\bvim?:.*\b(?:ft|filetype|syntax)=([\w+#.-]+)`)
+	// emacsModeline matches emacs modelines like "-*- mode: ruby -*-"
+	// or "-*- ruby -*-".
+	emacsModeline = regexp.MustCompile(`-\*-\s*(?:.*\bmode:\s*([\w+#.-]+)|([\w+#.-]+))\s*(?:;.*)?-\*-`)
+
+	// yamlLine matches the lines of yaml mappings and sequences.
+	yamlLine = regexp.MustCompile(`^\s*(?:- |-$|[\w./"'-]+:(?:\s|$))`)
+	// dockerfileStart matches the instructions a Dockerfile starts with.
+	dockerfileStart = regexp.MustCompile(`(?i)^(?:FROM|ARG)\s`)
+	// dockerfileLine matches the instructions of a Dockerfile.
+	dockerfileLine = regexp.MustCompile(`(?i)^(?:FROM|RUN|CMD|COPY|ADD|ENV|ARG|WORKDIR|ENTRYPOINT|EXPOSE|LABEL|USER|VOLUME)\s`)
+	// goPackage matches the package clause of a go file.
+	goPackage = regexp.MustCompile(`(?m)^package [a-zA-Z_]\w*\s*$`)
+
+	// interpreters are the languages of the interpreters
+	// in the shebangs of scripts.
+	interpreters = map[string]string{
+		"sh":      "bash",
+		"bash":    "bash",
+		"zsh":     "bash",
+		"ksh":     "bash",
+		"dash":    "bash",
+		"python":  "python",
+		"node":    "javascript",
+		"nodejs":  "javascript",
+		"deno":    "typescript",
+		"ruby":    "ruby",
+		"perl":    "perl",
+		"php":     "php",
+		"lua":     "lua",
+		"awk":     "awk",
+		"fish":    "fish",
+		"tclsh":   "tcl",
+		"Rscript": "r",
+	}
+)
+
+// sniffReader works out whether the paste is text from the start of its
+// contents, whatever content type the client sent, and detects the
+// language of text pastes from their filename or the start of their
+// contents if it was not set already. It sets them in the metadata once
+// the contents are read.
+type sniffReader struct {
+	r    io.Reader
+	head []byte
+	meta *Metadata
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if room := detectSize - len(s.head); room > 0 {
+		if room > n {
+			room = n
+		}
+		s.head = append(s.head, p[:room]...)
+	}
+	if err == io.EOF {
+		s.meta.Binary = !looksText(s.head)
+		if len(s.meta.Language) < 1 && isText(s.meta) {
+			s.meta.Language = detectLanguage(s.meta.Filename, s.head, len(s.head) < detectSize)
+		}
+	}
+	return n, err
+}
+
+// looksText returns whether the start of the contents of a paste is text,
+// without any of the control characters or null bytes of binary files.
+func looksText(head []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(head), "text/") && bytes.IndexByte(head, 0) < 0
+}
+
+// detectLanguage returns the language of the paste from its filename,
+// or from the start of its contents, or empty if it cannot tell. Whole is
+// whether head is all of the contents.
+func detectLanguage(filename string, head []byte, whole bool) string {
+	if len(filename) > 0 {
+		if l := lexers.Match(filename); l != nil {
+			return lexerLanguage(l)
+		}
+		if strings.HasPrefix(path.Base(filename), "Dockerfile") {
+			return "docker"
+		}
+	}
+
+	text := string(head)
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+
+	if lang := shebangLanguage(lines[0]); len(lang) > 0 {
+		return lang
+	}
+	if lang := modelineLanguage(lines); len(lang) > 0 {
+		return lang
+	}
+
+	switch {
+	case isDiff(lines):
+		return "diff"
+	case isJSON(head, whole):
+		return "json"
+	case isDockerfile(lines):
+		return "docker"
+	case isGo(text):
+		return "go"
+	case isYAML(lines):
+		return "yaml"
+	}
+	return ""
+}
+
+// lexerLanguage returns the language to store for the lexer,
+// its main alias or its name.
+func lexerLanguage(l chroma.Lexer) string {
+	if aliases := l.Config().Aliases; len(aliases) > 0 {
+		return aliases[0]
+	}
+	return strings.ToLower(l.Config().Name)
+}
+
+// shebangLanguage returns the language of the interpreter
+// in the shebang line of a script.
+func shebangLanguage(line string) string {
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) < 1 {
+		return ""
+	}
+
+	// skip env and its options, as in "#!/usr/bin/env -S python3 -u"
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+				interpreter = path.Base(f)
+				break
+			}
+		}
+	}
+
+	// drop the versions, as in python3.11
+	name := strings.TrimRight(interpreter, "0123456789.")
+	return interpreters[name]
+}
+
+// modelineLanguage returns the language of a vim or emacs modeline
+// in the first or last lines, if there is a lexer for it.
+func modelineLanguage(lines []string) string {
+	candidates := lines
+	if len(lines) > 10 {
+		candidates = append(append([]string{}, lines[:5]...), lines[len(lines)-5:]...)
+	}
+	for _, line := range candidates {
+		var lang string
+		if m := vimModeline.FindStringSubmatch(line); m != nil {
+			lang = m[1]
+		} else if m := emacsModeline.FindStringSubmatch(line); m != nil {
+			lang = m[1] + m[2]
+		} else {
+			continue
+		}
+		if l := findLexer(strings.ToLower(lang)); l != nil {
+			return lexerLanguage(l)
+		}
+	}
+	return ""
+}
+
+// isDiff returns whether the lines look like a unified diff.
+func isDiff(lines []string) bool {
+	for i, line := range lines {
+		if strings.HasPrefix(line, "diff --git ") {
+			return true
+		}
+		if strings.HasPrefix(line, "--- ") && i+2 < len(lines) &&
+			strings.HasPrefix(lines[i+1], "+++ ") && strings.HasPrefix(lines[i+2], "@@ ") {
+			return true
+		}
+	}
+	return false
+}
+
+// isJSON returns whether the contents are a json object or array. The
+// start of longer contents only has to be valid as far as it goes.
+func isJSON(head []byte, whole bool) bool {
+	trimmed := bytes.TrimSpace(head)
+	if len(trimmed) < 2 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+	if whole {
+		return json.Valid(trimmed)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	for {
+		if _, err := dec.Token(); err != nil {
+			return err == io.EOF || err == io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// isDockerfile returns whether the first instruction is FROM or ARG
+// and the other lines are mostly instructions.
+func isDockerfile(lines []string) bool {
+	var instructions, other int
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if instructions+other == 0 && !dockerfileStart.MatchString(line) {
+			return false
+		}
+		if dockerfileLine.MatchString(line) {
+			instructions++
+		} else {
+			other++
+		}
+	}
+	return instructions > 1 && instructions >= other
+}
+
+// isGo returns whether the contents have a package clause followed
+// by imports or declarations.
+func isGo(text string) bool {
+	loc := goPackage.FindStringIndex(text)
+	if loc == nil {
+		return false
+	}
+	rest := text[loc[1]:]
+	for _, decl := range []string{"\nimport ", "\nfunc ", "\ntype ", "\nvar ", "\nconst "} {
+		if strings.Contains(rest, decl) {
+			return true
+		}
+	}
+	return false
+}
+
+// isYAML returns whether the lines start a yaml document, or are
+// mostly yaml mappings and sequences.
+func isYAML(lines []string) bool {
+	if strings.TrimSpace(lines[0]) == "---" {
+		return true
+	}
+
+	var yaml, other int
+	for _, line := range lines {
+		if len(strings.TrimSpace(line)) < 1 || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if yamlLine.MatchString(line) {
+			yaml++
+		} else if !strings.HasPrefix(line, " ") {
+			// indented lines can be the values of block scalars
+			other++
+		}
+	}
+	return yaml > 1 && yaml > 2*other
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLooksText(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head string
+		text bool
+	}{
+		{"empty", "", true},
+		{"ruby", "class Foo\n  def bar; end\nend\n", true},
+		{"utf-8", "héllo wörld ✓\n", true},
+		{"ansi", "\x1b[31mred\x1b[0m\n", true},
+		{"html", "<!DOCTYPE html><p>hi</p>", true},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", false},
+		{"gzip", "\x1f\x8b\x08\x00\x00\x00\x00\x00", false},
+		{"elf", "\x7fELF\x02\x01\x01\x00", false},
+		{"null byte late", strings.Repeat("text\n", 200) + "\x00", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := looksText([]byte(tc.head)); got != tc.text {
+				t.Fatalf("looksText(%q) = %v, expected %v", tc.head, got, tc.text)
+			}
+		})
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		filename string
+		head     string
+		language string
+	}{
+		{"filename", "main.rb", "puts 1\n", "rb"},
+		{"filename over contents", "notes.txt", "#!/bin/sh\n", "text"},
+		{"dockerfile filename", "Dockerfile.dev", "RUN true\n", "docker"},
+		{"unknown filename", "notes.unknown", "package main\n\nfunc main() {}\n", "go"},
+
+		{"shebang", "", "#!/bin/bash\necho hi\n", "bash"},
+		{"env shebang", "", "#!/usr/bin/env node\nconsole.log(1)\n", "javascript"},
+		{"env shebang with options", "", "#!/usr/bin/env -S python3 -u\nprint(1)\n", "python"},
+		{"versioned shebang", "", "#!/usr/bin/python3.11\nprint(1)\n", "python"},
+		{"env shebang with variables", "", "#!/usr/bin/env LC_ALL=C ruby\nputs 1\n", "ruby"},
+		{"unknown shebang", "", "#!/usr/bin/frobnicate\nfoo\n", ""},
+
+		{"vim modeline", "", "foo = 1\n# vim: set ft=python:\n", "python"},
+		{"vi modeline", "", "// vi: filetype=rust\nfn main() {}\n", "rust"},
+		{"emacs modeline", "", "# -*- mode: ruby -*-\nputs 1\n", "rb"},
+		{"short emacs modeline", "", "# -*- perl -*-\nprint 1;\n", "perl"},
+		{"modeline of no lexer", "", "# vim: ft=frobnicate\n", ""},
+		{"modeline in the middle", "", strings.Repeat("x\n", 6) + "# vim: ft=python\n" + strings.Repeat("x\n", 6), ""},
+
+		{"git diff", "", "diff --git a/a.go b/a.go\nindex 1..2\n", "diff"},
+		{"unified diff", "", "--- a.txt\n+++ b.txt\n@@ -1 +1 @@\n-a\n+b\n", "diff"},
+		{"dashes", "", "--- a\nnot a diff\n", ""},
+
+		{"json object", "", `{"a": [1, 2]}`, "json"},
+		{"json array", "", "[1, 2, 3]\n", "json"},
+		{"invalid json", "", `{"a": }`, ""},
+
+		{"dockerfile", "", "FROM alpine\nRUN apk add git\nCMD [\"git\"]\n", "docker"},
+		{"dockerfile with arg", "", "# build\nARG VERSION\nFROM alpine:$VERSION\n", "docker"},
+		{"from in prose", "", "From here on\nwe walk.\n", ""},
+
+		{"go", "", "package main\n\nimport \"fmt\"\n", "go"},
+		{"package in prose", "", "package main\nis what it says\n", ""},
+
+		{"yaml document", "", "---\nfoo\n", "yaml"},
+		{"yaml", "", "name: test\non:\n  push:\njobs:\n  - build\n", "yaml"},
+		{"yaml block scalar", "", "script: |\n  echo hi\n  echo there\nname: x\n", "yaml"},
+
+		{"prose", "", "Hello,\n\nthis is just some text: nothing else.\n", ""},
+		{"logs", "", "2024-01-01 12:00:00 INFO started\n2024-01-01 12:00:01 WARN slow\n", ""},
+		{"empty", "", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := detectLanguage(tc.filename, []byte(tc.head), true); got != tc.language {
+				t.Fatalf("detectLanguage(%q, %q) = %q, expected %q", tc.filename, tc.head, got, tc.language)
+			}
+		})
+	}
+}
+
+func TestDetectLanguageTruncatedJSON(t *testing.T) {
+	head := []byte(`{"items": [{"name": "a"}, {"name": "b`)
+	if got := detectLanguage("", head, false); got != "json" {
+		t.Fatalf("the start of a json paste is detected as %q, expected json", got)
+	}
+	if got := detectLanguage("", head, true); got != "" {
+		t.Fatalf("a truncated json paste is detected as %q, expected nothing", got)
+	}
+	if got := detectLanguage("", []byte(`{"a": }`), false); got != "" {
+		t.Fatalf("the start of an invalid json paste is detected as %q, expected nothing", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// decryptPageHTML is the page that decrypts an end-to-end encrypted paste
+// in the browser with the key from the url fragment, which never gets
+// sent to the server.
+const decryptPageHTML = `<pre><code id="paste">Decrypting...</code></pre>
+<script>
+(function() {
+	var out = document.getElementById("paste");
+	function fromBase64(s) {
+		s = s.replace(/-/g, "+").replace(/_/g, "/");
+		while (s.length %% 4) { s += "="; }
+		return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+	}
+	var key = window.location.hash.slice(1);
+	if (!key) {
+		out.textContent = "This paste is encrypted and the link is missing the key after the #.";
+		return;
+	}
+	if (!window.crypto || !window.crypto.subtle) {
+		out.textContent = "Your browser can only decrypt this paste over https.";
+		return;
+	}
+	var data = fromBase64("%s");
+	window.crypto.subtle.importKey("raw", fromBase64(key), "AES-GCM", false, ["decrypt"]).then(function(k) {
+		return window.crypto.subtle.decrypt({name: "AES-GCM", iv: data.slice(0, 12)}, k, data.slice(12));
+	}).then(function(plain) {
+		out.textContent = new TextDecoder().decode(plain);
+	}).catch(function() {
+		out.textContent = "Decrypting the paste failed, check the key in the link.";
+	});
+})();
+</script>`
+
+// encryptPaste encrypts the content with a new random AES-256-GCM key,
+// returning the nonce prepended to the ciphertext and the url safe
+// base64 encoded key.
+func encryptPaste(content []byte) ([]byte, string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", err
+	}
+
+	return gcm.Seal(nonce, nonce, content, nil), base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// decryptPaste decrypts data from encryptPaste with the key.
+func decryptPaste(data []byte, key string) ([]byte, error) {
+	k, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key failed: %v", err)
+	}
+	if len(k) != 32 {
+		return nil, errors.New("invalid key, it should be 32 bytes")
+	}
+
+	gcm, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted paste is too short")
+	}
+
+	content, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("decrypting paste failed, check the key")
+	}
+	return content, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptPage returns the html page that decrypts the paste in the browser.
+func decryptPage(data []byte, _ *Metadata) (string, error) {
+	return fmt.Sprintf("%s%s%s", htmlBegin, fmt.Sprintf(decryptPageHTML, base64.StdEncoding.EncodeToString(data)), htmlEnd), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parseExpire parses an expiry like 1h, 1d, 1w or never into a duration.
+// Never returns a zero duration.
+func parseExpire(s string) (time.Duration, error) {
+	if s == "never" {
+		return 0, nil
+	}
+
+	// time.ParseDuration does not know about days and weeks.
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid expiry %q", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid expiry %q", s)
+	}
+	return d, nil
+}
+
+// expiresAt returns the time a paste created now should expire for the
+// requested expiry, applying the server's default and maximum expiry.
+// The zero time means it never expires.
+func (cmd *serverCommand) expiresAt(requested string) (time.Time, error) {
+	if len(requested) < 1 {
+		requested = cmd.defaultExpire
+	}
+	d, err := parseExpire(requested)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	max, err := parseExpire(cmd.maxExpire)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing --max-expire failed: %v", err)
+	}
+	if max > 0 && (d == 0 || d > max) {
+		d = max
+	}
+
+	if d == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().UTC().Add(d), nil
+}
+
+// expired returns whether the paste has expired.
+func expired(meta *Metadata) bool {
+	return !meta.Expires.IsZero() && time.Now().After(meta.Expires)
+}
+
+// reap deletes the expired pastes from the store, and the stale
+// resumable uploads, every interval until the context is done.
+func (cmd *serverCommand) reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cmd.uploads.reap(uploadMaxAge)
+		cmd.reapPastes()
+	}
+}
+
+// reapPastes deletes the expired pastes from the store.
+func (cmd *serverCommand) reapPastes() {
+	pastes, err := cmd.store.List()
+	if err != nil {
+		logrus.Warnf("listing pastes to reap failed: %v", err)
+		return
+	}
+	for _, meta := range pastes {
+		if !expired(meta) {
+			continue
+		}
+		if err := cmd.store.Delete(meta.ID); err != nil && err != errPasteNotFound {
+			logrus.Warnf("deleting expired paste %s failed: %v", meta.ID, err)
+			continue
+		}
+		logrus.Infof("expired paste %q deleted", meta.ID)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpire(t *testing.T) {
+	for _, tc := range []struct {
+		expire string
+		d      time.Duration
+	}{
+		{"never", 0},
+		{"30m", 30 * time.Minute},
+		{"1h", time.Hour},
+		{"2d", 48 * time.Hour},
+		{"1w", 7 * 24 * time.Hour},
+	} {
+		d, err := parseExpire(tc.expire)
+		if err != nil || d != tc.d {
+			t.Fatalf("parseExpire(%q) = %v, %v, expected %v", tc.expire, d, err, tc.d)
+		}
+	}
+	for _, expire := range []string{"", "0h", "-1h", "0d", "xd", "1y", "forever"} {
+		if _, err := parseExpire(expire); err == nil {
+			t.Fatalf("parseExpire(%q) did not fail", expire)
+		}
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	for _, tc := range []struct {
+		defaultExpire string
+		maxExpire     string
+		requested     string
+		d             time.Duration
+	}{
+		{"never", "never", "", 0},
+		{"never", "never", "1h", time.Hour},
+		{"1d", "never", "", 24 * time.Hour},
+		{"1d", "never", "never", 0},
+		{"never", "1w", "", 7 * 24 * time.Hour},
+		{"never", "1w", "2w", 7 * 24 * time.Hour},
+		{"never", "1w", "1h", time.Hour},
+	} {
+		cmd := &serverCommand{defaultExpire: tc.defaultExpire, maxExpire: tc.maxExpire}
+		expires, err := cmd.expiresAt(tc.requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.d == 0 {
+			if !expires.IsZero() {
+				t.Fatalf("%q with the default %s and maximum %s expires at %v, expected never", tc.requested, tc.defaultExpire, tc.maxExpire, expires)
+			}
+			continue
+		}
+		if d := time.Until(expires); d > tc.d || d < tc.d-time.Minute {
+			t.Fatalf("%q with the default %s and maximum %s expires in %v, expected %v", tc.requested, tc.defaultExpire, tc.maxExpire, d, tc.d)
+		}
+	}
+}
+
+func TestExpiredPaste(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	id := postTestPaste(t, srv, "alice", "expire=1h", "expiring")
+	kept := postTestPaste(t, srv, "alice", "", "kept")
+
+	meta, err := cmd.store.Stat(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(meta.Expires); d > time.Hour || d < 59*time.Minute {
+		t.Fatalf("paste expires in %v, expected an hour", d)
+	}
+
+	// expired pastes are gone before the reaper gets to them
+	meta.Expires = time.Now().Add(-time.Second)
+	if err := cmd.store.SetMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+	for _, view := range []string{"", "/raw", "/ansi"} {
+		resp, body := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/"+id+view, "", nil))
+		if resp.StatusCode != http.StatusGone {
+			t.Fatalf("getting %s%s returned %s, expected 410: %s", id, view, resp.Status, body)
+		}
+	}
+	_, index := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/", "admin", nil))
+	if strings.Contains(index, id) || !strings.Contains(index, kept) {
+		t.Fatalf("index lists the expired paste or not the other one:\n%s", index)
+	}
+
+	// and deleted once it does
+	cmd.reapPastes()
+	if _, err := cmd.store.Stat(id); err != errPasteNotFound {
+		t.Fatalf("stat of a reaped paste returned %v, expected errPasteNotFound", err)
+	}
+	if resp, _ := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/"+id, "", nil)); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("getting a reaped paste returned %s, expected 404", resp.Status)
+	}
+	if got := readPaste(t, cmd.store, kept); got != "kept" {
+		t.Fatalf("paste that does not expire is %q after reaping, expected kept", got)
+	}
+}
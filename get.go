@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const getHelp = `Get a paste and write it to stdout, decrypting it if the url has a key after the #.`
+
+func (cmd *getCommand) Name() string      { return "get" }
+func (cmd *getCommand) Args() string      { return "<ID|URL>" }
+func (cmd *getCommand) ShortHelp() string { return getHelp }
+func (cmd *getCommand) LongHelp() string  { return getHelp }
+func (cmd *getCommand) Hidden() bool      { return false }
+
+func (cmd *getCommand) Register(fs *flag.FlagSet) {}
+
+type getCommand struct{}
+
+func (cmd *getCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("pass the id or url of the paste")
+	}
+
+	uri := rawURI(args[0])
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	// public pastes do not need credentials, but send them if we have them
+	setAuth(req)
+	if len(pastePassword) > 0 {
+		req.Header.Set(pastePasswordHeader, pastePassword)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %v", uri, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return fmt.Errorf("unauthorized - please check your credentials: %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		// the server responds with json errors
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("reading response body failed: %v", err)
+		}
+		var response map[string]string
+		if err := json.Unmarshal(body, &response); err == nil && len(response["error"]) > 0 {
+			return fmt.Errorf("server responded with %s", response["error"])
+		}
+		return fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	// decrypt end-to-end encrypted pastes with the key from the fragment
+	if i := strings.Index(args[0], "#"); i >= 0 {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("reading response body failed: %v", err)
+		}
+		content, err := decryptPaste(data, args[0][i+1:])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+// rawURI returns the uri of the raw paste for a paste id or uri.
+func rawURI(paste string) string {
+	if i := strings.Index(paste, "#"); i >= 0 {
+		paste = paste[:i]
+	}
+	if !strings.HasPrefix(paste, "http") {
+		paste = baseuri + paste
+	}
+	paste = strings.TrimSuffix(paste, "/")
+	for _, suffix := range []string{"/raw", "/html", "/ansi"} {
+		paste = strings.TrimSuffix(paste, suffix)
+	}
+	return paste + "/raw"
+}
@@ -1,19 +1,28 @@
 module github.com/jessfraz/pastebinit
 
-go 1.14
+go 1.22
 
 require (
+	github.com/alecthomas/chroma/v2 v2.14.0
 	github.com/buildkite/terminal v3.1.0+incompatible
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/genuinetools/pkg v0.0.0-20180717201740-54e648406b2d
-	github.com/kr/pretty v0.1.0 // indirect
-	github.com/onsi/gomega v1.4.2 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/klauspost/compress v1.18.0
+	github.com/microcosm-cc/bluemonday v1.0.27
 	github.com/sirupsen/logrus v1.0.5
-	github.com/sourcegraph/annotate v0.0.0-20160123013949-f4cad6c6324d // indirect
-	github.com/sourcegraph/syntaxhighlight v0.0.0-20170531221838-bd320f5d308e
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.24.0
+)
+
+require (
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dlclark/regexp2 v1.11.0 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
-	golang.org/x/crypto v0.0.0-20180621125126-a49355c7e3f8 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/term v0.21.0 // indirect
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
 )
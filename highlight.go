@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+var (
+	// highlightStyle is the style of the highlighted pastes. Its classes
+	// are in static/highlight.css, which is written with
+	// highlightFormatter.WriteCSS.
+	highlightStyle = styles.Get("github")
+
+	// highlightFormatter writes the highlighted tokens of the pastes
+	// with classes rather than inline styles, and leaves the lines and
+	// the pre around them to numberLines.
+	highlightFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.PreventSurroundingPre(true))
+)
+
+// findLexer returns the lexer for the first of the languages, which can
+// be names, aliases or filenames, that has one, or nil if none do.
+func findLexer(langs ...string) chroma.Lexer {
+	for _, lang := range langs {
+		if len(lang) < 1 {
+			continue
+		}
+		if l := lexers.Get(lang); l != nil {
+			return l
+		}
+		if l := lexers.Match(lang); l != nil {
+			return l
+		}
+	}
+	return nil
+}
+
+// highlight returns the paste as html with numbered lines, highlighted
+// with the lexer for the first of the languages that has one, or as
+// escaped plain text.
+func highlight(data []byte, langs ...string) string {
+	lexer := findLexer(langs...)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(data))
+	if err == nil {
+		var buf bytes.Buffer
+		if err = highlightFormatter.Format(&buf, highlightStyle, iterator); err == nil {
+			return numberLines(buf.String(), "chroma")
+		}
+	}
+	return numberLines(html.EscapeString(string(data)), "")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultIDAlphabet is the alphabet of random ids.
+	defaultIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+	// idAttempts is how many ids are generated before giving
+	// up on finding a free one.
+	idAttempts = 10
+
+	// maxSlugLength is the maximum length of a vanity slug.
+	maxSlugLength = 64
+)
+
+var (
+	// errIDTaken is returned when the id asked for
+	// is already used by another paste.
+	errIDTaken = errors.New("paste id is already taken")
+
+	// reservedSlugs are the paths of the server that
+	// cannot be used as vanity slugs.
+	reservedSlugs = map[string]bool{
+		"api":    true,
+		"paste":  true,
+		"static": true,
+	}
+)
+
+// idGenerator generates the ids of new pastes, either random strings
+// of the alphabet or a number of words joined by dashes.
+type idGenerator struct {
+	length   int
+	alphabet string
+	words    int
+}
+
+// validate returns an error if the ids it generates could
+// not be used as paste ids.
+func (g *idGenerator) validate() error {
+	if g.words > 0 {
+		return nil
+	}
+	if g.length < 1 {
+		return fmt.Errorf("id length must be at least 1, got %d", g.length)
+	}
+	if len(g.alphabet) < 2 {
+		return errors.New("id alphabet must have at least 2 characters")
+	}
+	if !validID(g.alphabet) {
+		return fmt.Errorf("id alphabet %q can only have letters, digits, - and _", g.alphabet)
+	}
+	for i, c := range g.alphabet {
+		if strings.IndexRune(g.alphabet[i+1:], c) >= 0 {
+			return fmt.Errorf("id alphabet has %q more than once", c)
+		}
+	}
+	return nil
+}
+
+// generate returns a new id.
+func (g *idGenerator) generate() (string, error) {
+	if g.words < 1 {
+		return randomString(g.alphabet, g.length)
+	}
+
+	words := make([]string, g.words)
+	for i := range words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(idWords))))
+		if err != nil {
+			return "", err
+		}
+		words[i] = idWords[n.Int64()]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+// randomString returns a string of length characters
+// picked uniformly at random from the alphabet.
+func randomString(alphabet string, length int) (string, error) {
+	b := make([]byte, length)
+	r := make([]byte, length+(length/4))
+	// drop the random bytes past the last whole multiple of the
+	// alphabet so every character is as likely.
+	maxrb := 256 - (256 % len(alphabet))
+	i := 0
+	for {
+		if _, err := io.ReadFull(rand.Reader, r); err != nil {
+			return "", err
+		}
+		for _, rb := range r {
+			c := int(rb)
+			if c >= maxrb {
+				continue
+			}
+			b[i] = alphabet[c%len(alphabet)]
+			i++
+			if i == length {
+				return string(b), nil
+			}
+		}
+	}
+}
+
+// validSlug returns an error if the slug cannot be asked for as a paste id.
+func validSlug(slug string) error {
+	if !validID(slug) || len(slug) > maxSlugLength {
+		return fmt.Errorf("invalid slug %q, it can only have up to %d letters, digits, - and _", slug, maxSlugLength)
+	}
+	if reservedSlugs[strings.ToLower(slug)] {
+		return fmt.Errorf("slug %q is reserved", slug)
+	}
+	return nil
+}
+
+// idReservations holds the ids of the pastes that are being uploaded, so
+// two uploads to this server are not given the same id before either is
+// stored. It only saves them from failing, the store is what keeps ids
+// unique across servers, as Put fails with errIDTaken for ids that exist.
+type idReservations struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+// reserve reserves the id if no paste has it and it is not already
+// reserved, returning errIDTaken otherwise.
+func (r *idReservations) reserve(s Store, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ids[id] {
+		return errIDTaken
+	}
+	_, err := s.Stat(id)
+	if err == nil {
+		return errIDTaken
+	}
+	if err != errPasteNotFound {
+		return err
+	}
+
+	if r.ids == nil {
+		r.ids = map[string]bool{}
+	}
+	r.ids[id] = true
+	return nil
+}
+
+// release releases the id once the paste is stored or failed to be.
+func (r *idReservations) release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ids, id)
+}
+
+// reserveID reserves the id asked for, or a newly generated one if it is
+// empty, and returns it. The caller must release it.
+func (cmd *serverCommand) reserveID(id string) (string, error) {
+	if len(id) > 0 {
+		return id, cmd.reserved.reserve(cmd.store, id)
+	}
+
+	for i := 0; i < idAttempts; i++ {
+		id, err := cmd.ids.generate()
+		if err != nil {
+			return "", fmt.Errorf("id generation failed: %v", err)
+		}
+		err = cmd.reserved.reserve(cmd.store, id)
+		if err == errIDTaken {
+			continue
+		}
+		return id, err
+	}
+	return "", fmt.Errorf("no free paste id found after %d attempts, use longer ids", idAttempts)
+}
+
+// replayReader reads the contents of a paste, keeping what was read in a
+// temporary file so it can be read again from the start if storing the
+// paste has to be tried again.
+type replayReader struct {
+	r io.Reader
+	f *tempFile
+	n int64
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		if rr.f == nil {
+			f, ferr := ioutil.TempFile("", "pastebinit-replay-")
+			if ferr != nil {
+				return 0, ferr
+			}
+			rr.f = &tempFile{f}
+		}
+		if _, werr := rr.f.Write(p[:n]); werr != nil {
+			return 0, werr
+		}
+		rr.n += int64(n)
+	}
+	return n, err
+}
+
+// replay returns a reader of the contents from the start, reading what
+// was already read from the file and the rest as it is read.
+func (rr *replayReader) replay() io.Reader {
+	if rr.f == nil {
+		return rr
+	}
+	return io.MultiReader(io.NewSectionReader(rr.f, 0, rr.n), rr)
+}
+
+// Close removes the temporary file.
+func (rr *replayReader) Close() error {
+	if rr.f == nil {
+		return nil
+	}
+	return rr.f.Close()
+}
+
+// idWords are the words of the human readable ids.
+var idWords = []string{
+	"able", "acid", "acorn", "actor", "adobe", "agent", "alarm", "album",
+	"alley", "alpha", "amber", "angle", "ankle", "apple", "apron", "arena",
+	"arrow", "aspen", "atlas", "attic", "audio", "award", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barn", "basil", "beach", "beard",
+	"berry", "bison", "blade", "blank", "blaze", "bloom", "board", "bonus",
+	"boots", "brave", "bread", "brick", "bride", "brook", "brush", "bucket",
+	"bugle", "cabin", "cable", "cactus", "camel", "candy", "canoe", "canyon",
+	"cargo", "carpet", "cedar", "chalk", "charm", "cheese", "cherry", "chess",
+	"cider", "cinema", "circle", "citrus", "clay", "cliff", "cloud", "clover",
+	"coast", "cobra", "cocoa", "comet", "coral", "cotton", "couch", "crane",
+	"crayon", "creek", "crown", "cubic", "daisy", "dance", "delta", "denim",
+	"desert", "diner", "disco", "dolphin", "donut", "dragon", "dream", "drum",
+	"eagle", "easel", "echo", "elbow", "ember", "emerald", "engine", "falcon",
+	"fable", "feast", "fern", "ferry", "fiddle", "field", "flame", "flute",
+	"forest", "fossil", "fox", "frost", "galaxy", "garden", "garlic", "gecko",
+	"ginger", "glacier", "globe", "goose", "grape", "gravel", "harbor", "hazel",
+	"helmet", "heron", "honey", "hornet", "husky", "igloo", "iris", "island",
+	"ivory", "jacket", "jaguar", "jelly", "jewel", "jungle", "kayak", "kettle",
+	"kiwi", "koala", "ladder", "lagoon", "lantern", "lemon", "lilac", "lily",
+	"linen", "lizard", "llama", "lotus", "lunar", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "meteor", "mint", "mirror", "mocha", "monkey",
+	"moose", "mosaic", "nectar", "needle", "nickel", "noodle", "oasis", "ocean",
+	"olive", "onion", "opal", "orbit", "orchid", "otter", "owl", "paddle",
+	"panda", "paper", "parrot", "peach", "pebble", "pepper", "piano", "pickle",
+	"pilot", "pine", "planet", "plum", "pocket", "pony", "poppy", "prism",
+	"pumpkin", "puzzle", "quartz", "quill", "rabbit", "radar", "raven", "reef",
+	"ribbon", "river", "robin", "rocket", "salmon", "sand", "saturn", "scarf",
+	"shadow", "shell", "silver", "sketch", "sloth", "snow", "socket", "spark",
+	"spider", "spruce", "squid", "stone", "sugar", "summit", "sunset", "swan",
+	"tango", "teapot", "thunder", "tiger", "timber", "toast", "topaz", "torch",
+	"tulip", "tundra", "turtle", "valley", "velvet", "violet", "walnut", "walrus",
+	"wave", "willow", "window", "winter", "wizard", "yogurt", "zebra", "zinc",
+}
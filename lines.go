@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// numberLines returns the html of a paste in a pre with every line
+// numbered and anchored as #L<n>. The numbers are drawn by lines.css so
+// they are not copied along with the text, and lines.js highlights the
+// #L<n>-L<m> ranges.
+func numberLines(code, class string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<pre class="%s"><code>`, strings.TrimSpace("numbered "+class))
+	for i, line := range splitLines(code) {
+		n := i + 1
+		fmt.Fprintf(&b, `<span class="nl" id="L%d"><a class="gutter" href="#L%d" data-line="%d"></a>%s`+"\n</span>", n, n, n, line)
+	}
+	b.WriteString("</code></pre>")
+	return b.String()
+}
+
+// splitLines splits the html of a paste into lines, closing the tags
+// that are open at the end of each line and opening them again on the
+// next one, so every line is valid html on its own.
+func splitLines(code string) []string {
+	var (
+		lines []string
+		line  strings.Builder
+		// open holds the tags that are open, outermost first. The first
+		// reopen of them are still to be opened again on this line, which
+		// is only done once there is something in them.
+		open   []string
+		reopen int
+		empty  = true
+	)
+	write := func(s string) {
+		for _, tag := range open[:reopen] {
+			line.WriteString(tag)
+		}
+		reopen = 0
+		line.WriteString(s)
+		empty = false
+	}
+	endLine := func() {
+		for i := len(open) - 1; i >= reopen; i-- {
+			line.WriteString("</" + tagName(open[i]) + ">")
+		}
+		lines = append(lines, line.String())
+		line.Reset()
+		reopen = len(open)
+		empty = true
+	}
+
+	for len(code) > 0 {
+		switch code[0] {
+		case '\n':
+			endLine()
+			code = code[1:]
+		case '<':
+			// the text is escaped, so this is always a tag
+			end := strings.IndexByte(code, '>') + 1
+			if end < 1 {
+				end = len(code)
+			}
+			tag := code[:end]
+			code = code[end:]
+			switch {
+			case strings.HasPrefix(tag, "</"):
+				if len(open) < 1 {
+					continue
+				}
+				if len(open) <= reopen {
+					// it was never opened again on this line
+					reopen--
+				} else {
+					line.WriteString(tag)
+				}
+				open = open[:len(open)-1]
+			case strings.HasSuffix(tag, "/>") || voidTags[tagName(tag)]:
+				write(tag)
+			default:
+				write(tag)
+				open = append(open, tag)
+			}
+		default:
+			end := strings.IndexAny(code, "<\n")
+			if end < 0 {
+				end = len(code)
+			}
+			write(code[:end])
+			code = code[end:]
+		}
+	}
+
+	// a trailing newline does not start another line
+	if !empty || len(lines) < 1 {
+		endLine()
+	}
+	return lines
+}
+
+// voidTags are the html elements that are never closed.
+var voidTags = map[string]bool{
+	"br":  true,
+	"hr":  true,
+	"img": true,
+	"wbr": true,
+}
+
+// tagName returns the name of the element of an opening tag.
+func tagName(tag string) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(tag, "<"), "/")
+	if i := strings.IndexAny(name, " \t\n/>"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		code  string
+		lines []string
+	}{
+		{"empty", "", []string{""}},
+		{"newline", "\n", []string{""}},
+		{"trailing newline", "a\nb\n", []string{"a", "b"}},
+		{"blank line", "a\n\nb", []string{"a", "", "b"}},
+		{
+			"tag spanning lines",
+			`<span class="s">"a` + "\n" + `b"</span>`,
+			[]string{`<span class="s">"a</span>`, `<span class="s">b"</span>`},
+		},
+		{
+			"tag closed at the start of a line",
+			"<span>a\n</span>b",
+			[]string{"<span>a</span>", "b"},
+		},
+		{
+			"blank line in a tag",
+			"<span>a\n\nb</span>",
+			[]string{"<span>a</span>", "", "<span>b</span>"},
+		},
+		{
+			"nested tags",
+			"<b><i>x\ny</i></b>",
+			[]string{"<b><i>x</i></b>", "<b><i>y</i></b>"},
+		},
+		{"void tag", "a<br>\nb", []string{"a<br>", "b"}},
+		{"self closing tag", "a<img src=x />\nb", []string{"a<img src=x />", "b"}},
+		{"unmatched closing tag", "</span>a\nb", []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := splitLines(tc.code); !reflect.DeepEqual(got, tc.lines) {
+				t.Fatalf("splitLines(%q) = %q, expected %q", tc.code, got, tc.lines)
+			}
+		})
+	}
+}
+
+func TestNumberLines(t *testing.T) {
+	got := numberLines("a\n<b>c</b>", "chroma")
+	expected := `<pre class="numbered chroma"><code>` +
+		`<span class="nl" id="L1"><a class="gutter" href="#L1" data-line="1"></a>a` + "\n</span>" +
+		`<span class="nl" id="L2"><a class="gutter" href="#L2" data-line="2"></a><b>c</b>` + "\n</span>" +
+		`</code></pre>`
+	if got != expected {
+		t.Fatalf("numberLines returned\n%s\nexpected\n%s", got, expected)
+	}
+}
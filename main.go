@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 
@@ -23,6 +28,22 @@ var (
 	baseuri  string
 	username string
 	password string
+	token    string
+
+	expire string
+	burn   bool
+
+	visibility    string
+	slug          string
+	lang          string
+	pastePassword string
+	encrypt       bool
+	compress      string
+
+	// pasteFilename and pasteType are what is known
+	// about the paste being uploaded.
+	pasteFilename string
+	pasteType     string
 
 	debug bool
 )
@@ -39,6 +60,8 @@ func main() {
 	// Build the list of available commands.
 	p.Commands = []cli.Command{
 		&serverCommand{},
+		&tokenCommand{},
+		&getCommand{},
 	}
 
 	// Setup the global flags.
@@ -52,13 +75,32 @@ func main() {
 	p.FlagSet.StringVar(&password, "p", os.Getenv("PASTEBINIT_PASSWORD"), "password (or env var PASTEBINIT_PASSWORD)")
 	p.FlagSet.StringVar(&password, "password", os.Getenv("PASTEBINIT_PASSWORD"), "password (or env var PASTEBINIT_PASSWORD)")
 
+	p.FlagSet.StringVar(&token, "t", os.Getenv("PASTEBINIT_TOKEN"), "api token to use instead of the username and password (or env var PASTEBINIT_TOKEN)")
+	p.FlagSet.StringVar(&token, "token", os.Getenv("PASTEBINIT_TOKEN"), "api token to use instead of the username and password (or env var PASTEBINIT_TOKEN)")
+
+	p.FlagSet.StringVar(&expire, "expire", "", "when the paste expires (1h, 1d, 1w, never), the server default if empty")
+
+	p.FlagSet.BoolVar(&burn, "burn", false, "delete the paste after it is viewed once")
+
+	p.FlagSet.StringVar(&visibility, "visibility", "", "who can see the paste (public, unlisted, private), public if empty")
+
+	p.FlagSet.StringVar(&lang, "lang", "", "language of the paste for highlighting, detected by the server if empty")
+
+	p.FlagSet.StringVar(&slug, "slug", "", "id to ask for the paste to have instead of a generated one")
+
+	p.FlagSet.StringVar(&pastePassword, "paste-password", os.Getenv("PASTEBINIT_PASTE_PASSWORD"), "password needed to view the paste (or env var PASTEBINIT_PASTE_PASSWORD)")
+
+	p.FlagSet.BoolVar(&encrypt, "encrypt", false, "encrypt the paste so only people with the link can read it")
+
+	p.FlagSet.StringVar(&compress, "compress", "", "compress the paste on the way to the server (gzip, zstd)")
+
 	p.FlagSet.BoolVar(&debug, "d", false, "enable debug logging")
 	p.FlagSet.BoolVar(&debug, "debug", false, "enable debug logging")
 
 	// Set the before function.
 	p.Before = func(ctx context.Context) error {
 		// On ^C, or SIGTERM handle exit.
-		signals := make(chan os.Signal)
+		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, os.Interrupt)
 		signal.Notify(signals, syscall.SIGTERM)
 		_, cancel := context.WithCancel(ctx)
@@ -85,33 +127,58 @@ func main() {
 			baseuri = "http://" + baseuri
 		}
 
-		// make sure we have a username and password
-		if len(username) < 1 {
-			return errors.New("username cannot be empty")
-		}
-		if len(password) < 1 {
-			return errors.New("password cannot be empty")
-		}
-
 		return nil
 	}
 
 	p.Action = func(ctx context.Context, args []string) error {
+		if err := checkCredentials(); err != nil {
+			return err
+		}
+		if len(compress) > 0 && !validCompression(compress) {
+			return fmt.Errorf("unknown compression %q", compress)
+		}
+
 		// check if we are reading from a file or stdin
-		var content []byte
-		if len(args) == 0 {
-			content = readFromStdin()
-		} else {
-			filename := args[0]
-			content = readFromFile(filename)
+		content, size, err := openPaste(args)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		// work out what is being pasted from its name and first bytes
+		src := bufio.NewReader(content)
+		if len(args) > 0 {
+			pasteFilename = filepath.Base(args[0])
+		}
+		head, _ := src.Peek(512)
+		pasteType = detectContentType(pasteFilename, head)
+
+		// encrypt the paste, the key only goes in the url fragment
+		var (
+			body     io.Reader = src
+			fragment string
+		)
+		if encrypt {
+			// the browser decrypts the paste in one go, so it
+			// has to be encrypted in one go as well
+			plain, err := ioutil.ReadAll(src)
+			if err != nil {
+				return fmt.Errorf("reading paste failed: %v", err)
+			}
+			encrypted, key, err := encryptPaste(plain)
+			if err != nil {
+				return fmt.Errorf("encrypting paste failed: %v", err)
+			}
+			body, size = bytes.NewReader(encrypted), int64(len(encrypted))
+			fragment = "#" + key
 		}
 
-		pasteURI, err := postPaste(content)
+		pasteURI, err := postPaste(body, size)
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("Your paste has been uploaded here:\n%s\nthe raw object is here: %s/raw", pasteURI, pasteURI)
+		fmt.Printf("Your paste has been uploaded here:\n%s%s\nthe raw object is here: %s/raw%s", pasteURI, fragment, pasteURI, fragment)
 		return nil
 	}
 
@@ -119,38 +186,76 @@ func main() {
 	p.Run()
 }
 
-// readFromStdin returns everything in stdin.
-func readFromStdin() []byte {
-	stdin, err := ioutil.ReadAll(os.Stdin)
+// openPaste opens the file named in args, or stdin if there is none,
+// and returns its size, or -1 if it is not known up front.
+func openPaste(args []string) (io.ReadCloser, int64, error) {
+	if len(args) == 0 {
+		return ioutil.NopCloser(os.Stdin), -1, nil
+	}
+
+	filename := args[0]
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("No such file or directory: %q", filename)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening file %q failed: %v", filename, err)
+	}
+	fi, err := f.Stat()
 	if err != nil {
-		logrus.Fatalf("reading from stdin failed: %v", err)
+		f.Close()
+		return nil, 0, fmt.Errorf("opening file %q failed: %v", filename, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return f, -1, nil
 	}
-	return stdin
+	return f, fi.Size(), nil
 }
 
-// readFromFile returns the contents of a file.
-func readFromFile(filename string) []byte {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		logrus.Fatalf("No such file or directory: %q", filename)
+// detectContentType returns the mime type of the paste from the
+// extension of its filename, or from its first bytes if it has none.
+func detectContentType(filename string, head []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); len(t) > 0 {
+		return t
 	}
+	return http.DetectContentType(head)
+}
 
-	file, err := ioutil.ReadFile(filename)
-	if err != nil {
-		logrus.Fatalf("reading from file %q failed: %v", filename, err)
+// postPaste streams the paste content to the server and returns the
+// paste URI. The size is sent up front unless it is negative. Large
+// pastes are sent in chunks so the upload can resume after errors.
+func postPaste(content io.Reader, size int64) (string, error) {
+	if size > chunkedUploadThreshold {
+		return postChunked(content)
+	}
+	if size < 0 {
+		// see if stdin has more than the threshold in it
+		br := bufio.NewReaderSize(content, chunkedUploadThreshold+1)
+		if _, err := br.Peek(chunkedUploadThreshold + 1); err == nil {
+			return postChunked(br)
+		}
+		content = br
+	}
+
+	// compress the paste as it is sent
+	encoding := ""
+	if len(compress) > 0 && compress != compressionNone {
+		cr := compressReader(content, compress)
+		defer cr.Close()
+		content, size, encoding = cr, -1, compress
 	}
-	return file
-}
 
-// postPaste uploads the paste content to the server
-// and returns the paste URI.
-func postPaste(content []byte) (string, error) {
 	// create the request
-	req, err := http.NewRequest("POST", baseuri+"paste", bytes.NewBuffer(content))
+	req, err := newPasteRequest("POST", baseuri+"paste?"+pasteQuery().Encode(), content)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(username, password)
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	if len(encoding) > 0 {
+		req.Header.Set("Content-Encoding", encoding)
+	}
 
 	// do the request
 	client := &http.Client{}
@@ -160,32 +265,118 @@ func postPaste(content []byte) (string, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 401 {
-		return "", fmt.Errorf("unauthorized - please check your username and password: %d", resp.StatusCode)
+	response, err := readPasteResponse(resp)
+	if err != nil {
+		return "", err
+	}
+
+	pasteURI, ok := response["uri"]
+	if !ok {
+		return "", fmt.Errorf("what the hell did we get back even? %v", response)
+	}
+
+	return pasteURI, nil
+}
+
+// pasteQuery returns the paste options as query parameters.
+func pasteQuery() url.Values {
+	query := url.Values{}
+	if len(expire) > 0 {
+		query.Set("expire", expire)
+	}
+	if burn {
+		query.Set("burn", "true")
+	}
+	if len(visibility) > 0 {
+		query.Set("visibility", visibility)
+	}
+	if encrypt {
+		query.Set("encrypted", "true")
+	}
+	if len(slug) > 0 {
+		query.Set("slug", slug)
+	}
+	// the server only sees the ciphertext of encrypted pastes,
+	// so it is not told anything about them
+	if !encrypt {
+		if len(pasteFilename) > 0 {
+			query.Set("filename", pasteFilename)
+		}
+		if len(lang) > 0 {
+			query.Set("lang", lang)
+		}
+		if len(pasteType) > 0 {
+			query.Set("type", pasteType)
+		}
+	}
+	return query
+}
+
+// newPasteRequest creates a request to upload a paste, with the
+// paste password and the credentials.
+func newPasteRequest(method, uri string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if len(pastePassword) > 0 {
+		req.Header.Set(pastePasswordHeader, pastePassword)
+	}
+	setAuth(req)
+	return req, nil
+}
 
-	if resp.StatusCode == 413 {
-		return "", fmt.Errorf("%d: Payload Too Large. Make sure your proxy or load balancer allows request bodies as large as any file you wish to accept", resp.StatusCode)
+// readPasteResponse parses the json response of an upload request,
+// returning the error the server responded with if there is one.
+func readPasteResponse(resp *http.Response) (map[string]string, error) {
+	if resp.StatusCode == 401 {
+		return nil, fmt.Errorf("unauthorized - please check your credentials: %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("reading response body failed: %v", err)
+		return nil, fmt.Errorf("reading response body failed: %v", err)
 	}
 
 	var response map[string]string
 	if err = json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("parsing body as json failed: %v", err)
+		if resp.StatusCode == 413 {
+			// not the server's own size limit
+			return nil, fmt.Errorf("%d: Payload Too Large. Make sure your proxy or load balancer allows request bodies as large as any file you wish to accept", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("parsing body as json failed: %v", err)
 	}
 
 	if respError, ok := response["error"]; ok {
-		return "", fmt.Errorf("server responded with %s", respError)
+		return nil, fmt.Errorf("server responded with %s", respError)
 	}
 
-	pasteURI, ok := response["uri"]
-	if !ok {
-		return "", fmt.Errorf("what the hell did we get back even? %s", string(body))
+	return response, nil
+}
+
+// checkCredentials makes sure we have a token or a username and password.
+func checkCredentials() error {
+	if len(token) > 0 {
+		return nil
+	}
+	if len(username) < 1 {
+		return errors.New("username cannot be empty")
 	}
+	if len(password) < 1 {
+		return errors.New("password cannot be empty")
+	}
+	return nil
+}
 
-	return pasteURI, nil
+// setAuth adds the token, or the username and password if there is
+// no token, to the request.
+func setAuth(req *http.Request) {
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if len(username) > 0 {
+		req.SetBasicAuth(username, password)
+	}
 }
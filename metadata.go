@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxFilenameLength is the maximum length of the filename of a paste.
+	maxFilenameLength = 255
+	// maxLanguageLength is the maximum length of the language of a paste.
+	maxLanguageLength = 32
+)
+
+// cleanFilename returns the base name of the filename the paste was
+// uploaded from without any control characters, empty if nothing is left.
+func cleanFilename(filename string) string {
+	filename = path.Base(strings.Replace(filename, `\`, "/", -1))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, filename)
+	if filename == "." || filename == ".." || filename == "/" {
+		return ""
+	}
+	if len(filename) > maxFilenameLength {
+		// cut before the rune that does not fit, not in the middle of it
+		n := maxFilenameLength
+		for n > 0 && !utf8.RuneStart(filename[n]) {
+			n--
+		}
+		filename = filename[:n]
+	}
+	return strings.TrimSpace(filename)
+}
+
+// parseLanguage returns the language of the paste in lower case,
+// or an error if it is not a sensible language name.
+func parseLanguage(lang string) (string, error) {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if len(lang) > maxLanguageLength {
+		return "", fmt.Errorf("language %q is too long", lang)
+	}
+	for _, c := range lang {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("+#._-", c)) {
+			return "", fmt.Errorf("invalid language %q", lang)
+		}
+	}
+	return lang, nil
+}
+
+// parseContentType returns the mime type of the paste in its
+// canonical form, or an error if it is not a valid one.
+func parseContentType(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q: %v", contentType, err)
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// isText returns whether the paste is text that can be shown in a view.
+// The server sniffs it from the contents when they are uploaded, the
+// content type the client sent is only shown as a hint of what it is.
+func isText(meta *Metadata) bool {
+	return !meta.Binary
+}
+
+// contentName returns the name to show and download the paste as.
+func contentName(meta *Metadata) string {
+	if len(meta.Filename) > 0 {
+		return meta.Filename
+	}
+	return meta.ID
+}
+
+// contentDisposition returns the Content-Disposition header that
+// names the download after the filename of the paste.
+func contentDisposition(meta *Metadata, attachment bool) string {
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": contentName(meta)})
+}
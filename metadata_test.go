@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanFilename(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		expected string
+	}{
+		{"notes.txt", "notes.txt"},
+		{"/home/alice/notes.txt", "notes.txt"},
+		{`C:\Users\alice\notes.txt`, "notes.txt"},
+		{"no\ttes\x00.txt", "notes.txt"},
+		{"  notes.txt  ", "notes.txt"},
+		{"..", ""},
+		{"/", ""},
+		{"", ""},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxFilenameLength)},
+		// multibyte runes are cut before the one that does not fit
+		{strings.Repeat("é", 200), strings.Repeat("é", maxFilenameLength/2)},
+		{"a" + strings.Repeat("日", 100), "a" + strings.Repeat("日", (maxFilenameLength-1)/3)},
+		{strings.Repeat("ab", 126) + "😀.txt", strings.Repeat("ab", 126)},
+	} {
+		got := cleanFilename(tc.filename)
+		if got != tc.expected {
+			t.Fatalf("cleanFilename(%q) = %q, expected %q", tc.filename, got, tc.expected)
+		}
+		if !utf8.ValidString(got) || len(got) > maxFilenameLength {
+			t.Fatalf("cleanFilename(%q) = %q is not valid utf-8 within %d bytes", tc.filename, got, maxFilenameLength)
+		}
+	}
+}
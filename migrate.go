@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// migrate imports the pastes from the filesystem storage directory
+// into the configured storage driver.
+func (cmd *serverCommand) migrate() error {
+	if cmd.storeConfig.driver == "filesystem" || cmd.storeConfig.driver == "fs" {
+		return errors.New("migrate needs a --storage-driver other than filesystem to import into")
+	}
+
+	fs, err := newFilesystemStore(cmd.storeConfig.storage, cmd.storeConfig.layout)
+	if err != nil {
+		return err
+	}
+	src, err := cmd.storeConfig.wrap(fs)
+	if err != nil {
+		return err
+	}
+
+	n, err := copyStore(cmd.store, src)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("migrated %d pastes from %s", n, cmd.storeConfig.storage)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// pastePasswordHeader is the header holding the password of a paste
+	// for uploads and for clients like curl.
+	pastePasswordHeader = "X-Paste-Password"
+
+	// maxPasswordFailures is the number of wrong passwords a client can
+	// give for a paste within passwordFailureWindow before it is locked
+	// out of the paste.
+	maxPasswordFailures = 5
+	// passwordFailureWindow is how long wrong passwords are counted for,
+	// from the first one.
+	passwordFailureWindow = 15 * time.Minute
+	// passwordLockout is how long a client stays locked out of a paste.
+	passwordLockout = 15 * time.Minute
+)
+
+// unlockFormHTML is the form browsers use to send the password of a paste.
+const unlockFormHTML = `
+<form method="post">
+<p>%s</p>
+<input type="password" name="password" autofocus>
+<button type="submit">Unlock</button>
+</form>
+`
+
+// passwordLimiter locks clients out of pastes after too many wrong
+// passwords, so one client guessing cannot lock everyone else out.
+// It is keyed by passwordKey.
+type passwordLimiter struct {
+	mu       sync.Mutex
+	failures map[string]passwordFailures
+	locked   map[string]time.Time
+}
+
+// passwordFailures are the wrong passwords a client gave for a paste
+// since the first one.
+type passwordFailures struct {
+	count int
+	first time.Time
+}
+
+// passwordKey returns the key of the client address and paste
+// in the limiter.
+func passwordKey(client, id string) string {
+	return id + "\x00" + client
+}
+
+// isLocked returns whether the client is locked out of the paste.
+func (l *passwordLimiter) isLocked(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.locked[key]
+	if ok && time.Now().After(until) {
+		delete(l.locked, key)
+		return false
+	}
+	return ok
+}
+
+// fail records a wrong password from the client for the paste, locking
+// the client out if there were too many within the window.
+func (l *passwordLimiter) fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.failures == nil {
+		l.failures = map[string]passwordFailures{}
+		l.locked = map[string]time.Time{}
+	}
+	// forget the failures and lockouts that are over, so they do not
+	// pile up for every client that ever got a password wrong
+	for k, f := range l.failures {
+		if now.Sub(f.first) > passwordFailureWindow {
+			delete(l.failures, k)
+		}
+	}
+	for k, until := range l.locked {
+		if now.After(until) {
+			delete(l.locked, k)
+		}
+	}
+
+	f, ok := l.failures[key]
+	if !ok {
+		f.first = now
+	}
+	f.count++
+	if f.count >= maxPasswordFailures {
+		delete(l.failures, key)
+		l.locked[key] = now.Add(passwordLockout)
+		return
+	}
+	l.failures[key] = f
+}
+
+// reset forgets the wrong passwords from the client for the paste.
+func (l *passwordLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// loadCookieKey reads the key of the unlock cookies from the file at
+// path, creating it with a random key if it does not exist, so the cookies
+// keep working after a restart and on all the servers sharing the file.
+func loadCookieKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		err = createFileAtomic(path, strings.NewReader(hex.EncodeToString(key)), 0600)
+		if err == nil {
+			return key, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("writing cookie key file %q failed: %v", path, err)
+		}
+		// another server created it in the meantime
+		b, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cookie key file %q failed: %v", path, err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("cookie key file %q must hold a hex encoded key of at least 32 bytes", path)
+	}
+	return key, nil
+}
+
+// unlockCookie returns the name and value of the cookie that proves
+// the password of the paste was given.
+func (cmd *serverCommand) unlockCookie(meta *Metadata) (string, string) {
+	mac := hmac.New(sha256.New, cmd.cookieKey)
+	mac.Write([]byte(meta.ID + "\x00" + meta.PasswordHash))
+	return "pastebinit-unlock-" + meta.ID, hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorizePassword makes sure the requester gave the password of the
+// paste, writing the error response or unlock form and returning false
+// if they did not. The password is read from the unlock cookie, the
+// X-Paste-Password header, the password query parameter or the
+// unlock form.
+func (cmd *serverCommand) authorizePassword(w http.ResponseWriter, r *http.Request, meta *Metadata, raw bool) bool {
+	if len(meta.PasswordHash) < 1 {
+		return true
+	}
+
+	name, value := cmd.unlockCookie(meta)
+	if c, err := r.Cookie(name); err == nil && hmac.Equal([]byte(c.Value), []byte(value)) {
+		return true
+	}
+
+	key := passwordKey(cmd.proxies.clientAddr(r), meta.ID)
+	if cmd.passwords.isLocked(key) {
+		writeErrorStatus(w, http.StatusTooManyRequests, fmt.Sprintf("Paste %s is locked after too many wrong passwords, try again later", meta.ID))
+		return false
+	}
+
+	pass := r.Header.Get(pastePasswordHeader)
+	if len(pass) < 1 {
+		pass = r.URL.Query().Get("password")
+	}
+	if len(pass) < 1 && r.Method == "POST" {
+		pass = r.PostFormValue("password")
+	}
+
+	msg := "This paste is protected by a password."
+	if len(pass) > 0 {
+		if bcrypt.CompareHashAndPassword([]byte(meta.PasswordHash), []byte(pass)) == nil {
+			cmd.passwords.reset(key)
+			http.SetCookie(w, &http.Cookie{
+				Name:     name,
+				Value:    value,
+				Path:     "/" + meta.ID,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			return true
+		}
+		cmd.passwords.fail(key)
+		msg = "Wrong password."
+	}
+
+	if raw {
+		writeErrorStatus(w, http.StatusForbidden, fmt.Sprintf("%s Send it in the %s header.", msg, pastePasswordHeader))
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "%s%s%s", htmlBegin, fmt.Sprintf(unlockFormHTML, html.EscapeString(msg)), htmlEnd)
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPasswordLimiter(t *testing.T) {
+	var l passwordLimiter
+	for i := 0; i < maxPasswordFailures-1; i++ {
+		l.fail("paste\x00a")
+	}
+	if l.isLocked("paste\x00a") {
+		t.Fatalf("locked after %d wrong passwords", maxPasswordFailures-1)
+	}
+	l.fail("paste\x00a")
+	if !l.isLocked("paste\x00a") {
+		t.Fatalf("not locked after %d wrong passwords", maxPasswordFailures)
+	}
+
+	// other clients and pastes are not locked out
+	if l.isLocked("paste\x00b") || l.isLocked("other\x00a") {
+		t.Fatal("the lockout of one client and paste locked out others")
+	}
+
+	// the lockout ends
+	l.locked["paste\x00a"] = time.Now().Add(-time.Second)
+	if l.isLocked("paste\x00a") {
+		t.Fatal("still locked after the lockout ended")
+	}
+}
+
+func TestPasswordLimiterWindow(t *testing.T) {
+	var l passwordLimiter
+	for i := 0; i < maxPasswordFailures-1; i++ {
+		l.fail("paste\x00a")
+	}
+
+	// the failures are forgotten once the window is over
+	f := l.failures["paste\x00a"]
+	f.first = time.Now().Add(-passwordFailureWindow - time.Second)
+	l.failures["paste\x00a"] = f
+	l.fail("paste\x00a")
+	if l.isLocked("paste\x00a") {
+		t.Fatal("locked by wrong passwords from before the window")
+	}
+	if got := l.failures["paste\x00a"].count; got != 1 {
+		t.Fatalf("%d wrong passwords counted after the window, expected 1", got)
+	}
+
+	// and when the right password is given
+	l.reset("paste\x00a")
+	for i := 0; i < maxPasswordFailures-1; i++ {
+		l.fail("paste\x00a")
+	}
+	if l.isLocked("paste\x00a") {
+		t.Fatal("locked by wrong passwords from before the right one")
+	}
+}
+
+func TestLoadCookieKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pastebinit", "cookie.key")
+	key, err := loadCookieKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("created a key of %d bytes, expected 32", len(key))
+	}
+
+	// the key is the same after a restart
+	again, err := loadCookieKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Fatal("loading the cookie key again returned another key")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not hex"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCookieKey(path); err == nil {
+		t.Fatal("loading an invalid cookie key did not fail")
+	}
+}
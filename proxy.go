@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of the reverse proxies in front of the
+// server, which are trusted to tell the address of the client in the
+// X-Forwarded-For header.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of addresses and cidrs.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) < 1 {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			_, n, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, n)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return proxies, nil
+}
+
+// contains returns whether the address is one of the proxies.
+func (p trustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client the request came from.
+// Requests from the proxies are from the last address in X-Forwarded-For
+// that is not one of them, as the ones before it can be made up by the
+// client.
+func (p trustedProxies) clientAddr(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !p.contains(addr) {
+		return addr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		v := strings.TrimSpace(forwarded[i])
+		if len(v) < 1 {
+			continue
+		}
+		if !p.contains(v) {
+			return v
+		}
+		addr = v
+	}
+	return addr
+}
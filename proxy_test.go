@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		remote    string
+		forwarded []string
+		client    string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"direct ipv6", "[2001:db8::7]:1234", nil, "2001:db8::7"},
+		{"untrusted forwarded for", "198.51.100.7:1234", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"proxy", "192.0.2.1:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"ipv6 proxy", "[2001:db8::1]:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"proxies", "10.1.2.3:1234", []string{"203.0.113.9, 10.4.5.6"}, "203.0.113.9"},
+		{"proxies in headers", "10.1.2.3:1234", []string{"203.0.113.9", "10.4.5.6"}, "203.0.113.9"},
+		{"made up by the client", "192.0.2.1:1234", []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"no forwarded for", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"only proxies", "192.0.2.1:1234", []string{"10.4.5.6"}, "10.4.5.6"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/paste", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := proxies.clientAddr(r); got != tc.client {
+				t.Fatalf("client address is %q, expected %q", got, tc.client)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for s, n := range map[string]int{"": 0, "10.0.0.1,": 1, " 10.0.0.0/8 , ::1": 2} {
+		proxies, err := parseTrustedProxies(s)
+		if err != nil || len(proxies) != n {
+			t.Fatalf("parsing %q returned %v, %v, expected %d proxies", s, proxies, err, n)
+		}
+	}
+	for _, s := range []string{"nope", "10.0.0.0/33", "10.0.0.1, example.com"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Fatalf("parsing %q did not fail", s)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reencrypt encrypts all the pastes that are not encrypted with the first
+// key in the --encryption-key-file with it, so old keys can be removed.
+func (cmd *serverCommand) reencrypt() error {
+	s, ok := findEncryptedStore(cmd.store)
+	if !ok || len(s.primary) < 1 {
+		return errors.New("reencrypt needs an --encryption-key-file")
+	}
+
+	pastes, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, p := range pastes {
+		if p.EncryptionKey == s.primary {
+			continue
+		}
+		if err := s.reencrypt(p.ID); err != nil {
+			return fmt.Errorf("reencrypting paste %s failed: %v", p.ID, err)
+		}
+		n++
+	}
+	logrus.Infof("reencrypted %d pastes with key %q", n, s.primary)
+	return nil
+}
+
+// findEncryptedStore returns the encryptedStore among the stores wrapped
+// by s. Blobs are only visible to the stores below the dedupStore, so
+// this is what has to be reencrypted.
+func findEncryptedStore(s Store) (*encryptedStore, bool) {
+	for _, s := range unwrapStore(s) {
+		if es, ok := s.(*encryptedStore); ok {
+			return es, true
+		}
+	}
+	return nil, false
+}
+
+// reencrypt decrypts the paste and stores it again with the primary key.
+func (s *encryptedStore) reencrypt(id string) error {
+	rc, meta, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// the store cannot be read from and written to at the same
+	// time, so spool the plaintext to a temporary file first.
+	tmp, err := ioutil.TempFile("", "pastebinit-reencrypt-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, rc); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.Replace(id, tmp, meta)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/microcosm-cc/bluemonday"
+)
+
+const (
+	// htmlModeSanitize serves the /html view of pastes with everything
+	// that is not in htmlPolicy removed.
+	htmlModeSanitize = "sanitize"
+	// htmlModeSandbox serves the /html view of pastes as they are, in a
+	// sandbox with its own origin and without scripts.
+	htmlModeSandbox = "sandbox"
+	// htmlModeOff does not serve the /html view of pastes.
+	htmlModeOff = "off"
+)
+
+const (
+	// sanitizedCSP is the content security policy of sanitized pastes,
+	// in case something gets past the sanitizer.
+	sanitizedCSP = "default-src 'none'; img-src * data:; sandbox"
+	// sandboxedCSP is the content security policy of sandboxed pastes.
+	// Without allow-same-origin they cannot read the cookies or make
+	// requests with the credentials of this origin, and without
+	// allow-scripts they cannot run scripts at all.
+	sandboxedCSP = "sandbox"
+)
+
+// htmlPolicy is the allowlist of the elements and attributes of sanitized
+// pastes, the formatting, links, images and tables of user generated
+// content without any scripts, styles, frames or forms.
+var htmlPolicy = bluemonday.UGCPolicy()
+
+// sanitizeHTML returns the html of a paste with everything
+// that is not in htmlPolicy removed.
+func sanitizeHTML(data []byte, _ *Metadata) (string, error) {
+	return string(htmlPolicy.SanitizeBytes(data)), nil
+}
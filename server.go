@@ -1,22 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buildkite/terminal"
 	"github.com/sirupsen/logrus"
-	"github.com/sourcegraph/syntaxhighlight"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -27,18 +27,29 @@ const (
 <link rel="shortcut icon" href="/static/favicon.ico" />
 <link rel="stylesheet" media="all" href="/static/main.css"/>
 <link rel="stylesheet" media="all" href="/static/ansi.css"/>
+<link rel="stylesheet" media="all" href="/static/highlight.css"/>
+<link rel="stylesheet" media="all" href="/static/lines.css"/>
+<script src="/static/lines.js" defer></script>
 </head>
 <body>`
 	htmlEnd string = `</body>
 </html>`
 
-	serverHelp = `Run the server.`
+	serverHelp     = `Run the server.`
+	serverLongHelp = `Run the server.
+
+Commands:
+
+  migrate    Import the pastes in the --storage directory into the --storage-driver.
+  reencrypt  Encrypt all the pastes with the first key in the --encryption-key-file.
+  shard      Move the pastes in the --storage directory into the --storage-layout.
+  verify     Check all the pastes against their checksums.`
 )
 
 func (cmd *serverCommand) Name() string      { return "server" }
-func (cmd *serverCommand) Args() string      { return "[OPTIONS]" }
+func (cmd *serverCommand) Args() string      { return "[OPTIONS] [COMMAND]" }
 func (cmd *serverCommand) ShortHelp() string { return serverHelp }
-func (cmd *serverCommand) LongHelp() string  { return serverHelp }
+func (cmd *serverCommand) LongHelp() string  { return serverLongHelp }
 func (cmd *serverCommand) Hidden() bool      { return false }
 
 func (cmd *serverCommand) Register(fs *flag.FlagSet) {
@@ -46,8 +57,28 @@ func (cmd *serverCommand) Register(fs *flag.FlagSet) {
 	fs.StringVar(&cmd.key, "key", "", "path to ssl key")
 	fs.StringVar(&cmd.port, "port", "8080", "port for server to run on")
 
-	fs.StringVar(&cmd.storage, "s", "/etc/pastebinit/files", "directory to store pastes")
-	fs.StringVar(&cmd.storage, "storage", "/etc/pastebinit/files", "directory to store pastes")
+	cmd.storeConfig.register(fs)
+
+	fs.StringVar(&cmd.defaultExpire, "default-expire", "never", "expiry for pastes that do not ask for one (1h, 1d, 1w, never)")
+	fs.StringVar(&cmd.maxExpire, "max-expire", "never", "maximum expiry a paste can ask for (1h, 1d, 1w, never)")
+	fs.DurationVar(&cmd.reapInterval, "reap-interval", time.Minute, "how often to delete expired pastes")
+
+	fs.StringVar(&cmd.maxSizeFlag, "max-size", "0", "maximum size of a paste (512K, 10M, 1G), 0 for no limit")
+	fs.IntVar(&cmd.ids.length, "id-length", 8, "length of the random paste ids")
+	fs.StringVar(&cmd.ids.alphabet, "id-alphabet", defaultIDAlphabet, "characters of the random paste ids")
+	fs.IntVar(&cmd.ids.words, "id-words", 0, "use this many words joined by dashes as paste ids instead of random characters, 0 for random ids")
+
+	fs.StringVar(&cmd.uploadsDir, "uploads-dir", "/etc/pastebinit/uploads", "directory to keep unfinished resumable uploads in")
+
+	fs.StringVar(&cmd.authFile, "auth-file", "", "htpasswd style file of users with bcrypt passwords")
+	fs.StringVar(&cmd.authEnv, "auth-env", "PASTEBINIT", "prefix of the <prefix>_USERNAME and <prefix>_PASSWORD env vars of the admin, used if there is no --auth-file")
+	fs.StringVar(&cmd.authMode, "auth-mode", authModeAll, "what needs auth, all requests to the index and uploads (all) or only uploads (writes)")
+
+	fs.StringVar(&cmd.htmlMode, "html-mode", htmlModeSanitize, "how the /html view of pastes is served, sanitized (sanitize), as it is in a sandbox (sandbox) or not at all (off)")
+
+	fs.StringVar(&cmd.tokensFile, "tokens-file", "/etc/pastebinit/tokens.json", "file to keep the api tokens in")
+	fs.StringVar(&cmd.cookieKeyFile, "cookie-key-file", "/etc/pastebinit/cookie.key", "file with the key of the unlock cookies of password protected pastes, created if it does not exist")
+	fs.StringVar(&cmd.trustedProxiesFlag, "trusted-proxies", "", "comma separated addresses or cidrs of the reverse proxies in front of the server, whose X-Forwarded-For header is trusted for the address of clients")
 
 	fs.StringVar(&cmd.assetPath, "asset-path", "/src/static", "Path to assets and templates")
 }
@@ -57,8 +88,40 @@ type serverCommand struct {
 	key  string
 	port string
 
-	storage   string
-	assetPath string
+	storeConfig storeConfig
+	assetPath   string
+
+	defaultExpire string
+	maxExpire     string
+	reapInterval  time.Duration
+
+	maxSizeFlag string
+	maxSize     int64
+
+	ids      idGenerator
+	reserved idReservations
+
+	uploadsDir string
+	uploads    *uploadStore
+
+	authFile string
+	authEnv  string
+	authMode string
+	users    map[string]*user
+
+	tokensFile string
+	tokens     *tokenStore
+
+	htmlMode string
+
+	store Store
+
+	passwords     passwordLimiter
+	cookieKeyFile string
+	cookieKey     []byte
+
+	trustedProxiesFlag string
+	proxies            trustedProxies
 }
 
 // JSONResponse is a map[string]string
@@ -79,26 +142,97 @@ func (j JSONResponse) String() string {
 }
 
 func (cmd *serverCommand) Run(ctx context.Context, args []string) error {
-	// create the storage directory
-	if err := os.MkdirAll(cmd.storage, 0755); err != nil {
-		logrus.Fatalf("creating storage directory %q failed: %v", cmd.storage, err)
+	// open the paste storage
+	store, err := cmd.storeConfig.open()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	cmd.store = store
+
+	// run any maintenance commands instead of the server
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			return cmd.migrate()
+		case "reencrypt":
+			return cmd.reencrypt()
+		case "shard":
+			return cmd.shard()
+		case "verify":
+			return cmd.verify()
+		default:
+			return fmt.Errorf("%s: no such server command", args[0])
+		}
 	}
 
-	// create mux server
-	mux := http.NewServeMux()
+	// load the users
+	if len(cmd.authFile) > 0 {
+		users, err := loadUsers(cmd.authFile)
+		if err != nil {
+			return err
+		}
+		cmd.users = users
+		logrus.Infof("loaded %d users from %s", len(users), cmd.authFile)
+	} else {
+		users, err := envUsers(cmd.authEnv)
+		if err != nil {
+			return err
+		}
+		cmd.users = users
+	}
+	if cmd.authMode != authModeAll && cmd.authMode != authModeWrites {
+		return fmt.Errorf("unknown auth mode %q", cmd.authMode)
+	}
+	if cmd.htmlMode != htmlModeSanitize && cmd.htmlMode != htmlModeSandbox && cmd.htmlMode != htmlModeOff {
+		return fmt.Errorf("unknown html mode %q", cmd.htmlMode)
+	}
 
-	// static files handler
-	staticHandler := http.StripPrefix("/static/", http.FileServer(http.Dir(cmd.assetPath)))
-	mux.Handle("/static/", staticHandler)
+	// load the api tokens
+	tokens, err := loadTokens(cmd.tokensFile)
+	if err != nil {
+		return err
+	}
+	cmd.tokens = tokens
 
-	// pastes & view handlers
-	mux.HandleFunc("/paste", cmd.pasteUploadHandler) // paste upload handler
-	mux.HandleFunc("/", cmd.pasteHandler)            // index & paste server handler
+	// open the directory for resumable uploads
+	uploads, err := newUploadStore(cmd.uploadsDir)
+	if err != nil {
+		return err
+	}
+	cmd.uploads = uploads
+
+	// load the key for the unlock cookies of password protected pastes
+	if cmd.cookieKey, err = loadCookieKey(cmd.cookieKeyFile); err != nil {
+		return err
+	}
+
+	// parse the addresses of the reverse proxies
+	if cmd.proxies, err = parseTrustedProxies(cmd.trustedProxiesFlag); err != nil {
+		return fmt.Errorf("parsing --trusted-proxies failed: %v", err)
+	}
+
+	// make sure the expiry policy is valid
+	if _, err := cmd.expiresAt(""); err != nil {
+		return fmt.Errorf("invalid expiry policy: %v", err)
+	}
+
+	// parse the maximum paste size
+	if cmd.maxSize, err = parseSize(cmd.maxSizeFlag); err != nil {
+		return fmt.Errorf("parsing --max-size failed: %v", err)
+	}
+
+	// make sure the paste ids can be generated
+	if err := cmd.ids.validate(); err != nil {
+		return err
+	}
+
+	// delete expired pastes in the background
+	go cmd.reap(ctx, cmd.reapInterval)
 
 	// Set up the server.
 	server := &http.Server{
 		Addr:    ":" + cmd.port,
-		Handler: mux,
+		Handler: cmd.handler(),
 	}
 	logrus.Infof("Starting server on port %s", cmd.port)
 	if len(cmd.cert) > 0 && len(cmd.key) > 0 {
@@ -107,34 +241,56 @@ func (cmd *serverCommand) Run(ctx context.Context, args []string) error {
 	return server.ListenAndServe()
 }
 
+// handler returns the handler of all the routes of the server.
+func (cmd *serverCommand) handler() http.Handler {
+	// create mux server
+	mux := http.NewServeMux()
+
+	// static files handler
+	staticHandler := http.StripPrefix("/static/", http.FileServer(http.Dir(cmd.assetPath)))
+	mux.Handle("/static/", staticHandler)
+
+	// pastes & view handlers
+	mux.HandleFunc("/paste", cmd.pasteUploadHandler)      // paste upload handler
+	mux.HandleFunc("/paste/uploads", cmd.uploadsHandler)  // resumable upload create handler
+	mux.HandleFunc("/paste/uploads/", cmd.uploadsHandler) // resumable upload chunk & finish handler
+	mux.HandleFunc("/api/tokens", cmd.tokensHandler)      // api token list & create handler
+	mux.HandleFunc("/api/tokens/", cmd.tokensHandler)     // api token revoke handler
+	mux.HandleFunc("/api/pastes/", cmd.pastesHandler)     // api paste metadata handler
+	mux.HandleFunc("/", cmd.pasteHandler)                 // index & paste server handler
+
+	return mux
+}
+
 // generateIndexHTML generates the html for the index page
-// to list all the pastes, via walking the storage directory.
-func (cmd *serverCommand) generateIndexHTML() (string, error) {
+// to list all the pastes in the store the user can see.
+func (cmd *serverCommand) generateIndexHTML(u *user) (string, error) {
 	var files string
 
-	// create the function to walk the pastes files
-	walkPastes := func(pth string, f os.FileInfo, err error) error {
-		base := filepath.Base(pth)
-		if base != cmd.storage {
-			files += fmt.Sprintf(`<tr>
+	pastes, err := cmd.store.List()
+	if err != nil {
+		return "", fmt.Errorf("listing pastes failed: %v", err)
+	}
+
+	for _, meta := range pastes {
+		if expired(meta) || !u.canSee(meta) {
+			continue
+		}
+		files += fmt.Sprintf(`<tr>
 <td><a href="%s%s">%s</a></td>
 <td>%s</td>
+<td>%s</td>
+<td>%s</td>
 <td>%d</td>
-</tr>`, baseuri, base, base, f.ModTime().Format("2006-01-02T15:04:05Z07:00"), f.Size())
-		}
-		return nil
-	}
-
-	// walk the pastes
-	if err := filepath.Walk(cmd.storage, walkPastes); err != nil {
-		return "", fmt.Errorf("walking %s failed: %v", cmd.storage, err)
+<td>%s</td>
+</tr>`, baseuri, meta.ID, meta.ID, html.EscapeString(meta.Filename), html.EscapeString(meta.Language), meta.Created.Format("2006-01-02T15:04:05Z07:00"), meta.Size, html.EscapeString(meta.Owner))
 	}
 
-	html := fmt.Sprintf(`%s
+	index := fmt.Sprintf(`%s
 <table>
 	<thead>
 		<tr>
-			<th>name</th><th>modified</th><th>size</th>
+			<th>name</th><th>file</th><th>language</th><th>modified</th><th>size</th><th>owner</th>
 		</tr>
 	</thead>
 	<tbody>
@@ -143,7 +299,7 @@ func (cmd *serverCommand) generateIndexHTML() (string, error) {
 </table>
 %s`, htmlBegin, files, htmlEnd)
 
-	return html, nil
+	return index, nil
 }
 
 // pasteHandler is the request handler for / and /{pasteid}
@@ -151,16 +307,17 @@ func (cmd *serverCommand) generateIndexHTML() (string, error) {
 // and returns the paste to the public if /{pasteid} exists.
 func (cmd *serverCommand) pasteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/" {
-		// they want the root, make them auth
-		u, p, ok := r.BasicAuth()
-		if (u != username || p != password) || !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="`+baseuri+`"`)
-			w.WriteHeader(401)
-			w.Write([]byte("401 Unauthorized\n"))
-			return
+		// they want the root, make them auth unless reads are open
+		var u *user
+		if cmd.authMode == authModeAll || hasCredentials(r) {
+			var ok bool
+			if u, ok = cmd.authenticate(r, scopeReadPrivate); !ok {
+				writeUnauthorized(w)
+				return
+			}
 		}
 
-		html, err := cmd.generateIndexHTML()
+		html, err := cmd.generateIndexHTML(u)
 		if err != nil {
 			writeError(w, fmt.Sprintf("generating index html failed: %v", err))
 			return
@@ -173,61 +330,171 @@ func (cmd *serverCommand) pasteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := filepath.Join(cmd.storage, filepath.FromSlash(path.Clean("/"+strings.Trim(r.URL.Path, "/"))))
+	filename := strings.Trim(r.URL.Path, "/")
 
-	var handler func(data []byte) (string, error)
+	var (
+		handler func(data []byte, meta *Metadata) (string, error)
+		raw     bool
+		// csp is the content security policy of the paste, which is only
+		// set once it is served so the unlock and burn forms still work
+		csp string
+	)
 
 	if strings.HasSuffix(filename, "/raw") {
 		// if they want the raw file serve a text/plain Content-Type
 		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 		// trim '/raw' from the filename so we can get the right file
 		filename = strings.TrimSuffix(filename, "/raw")
-		handler = func(data []byte) (string, error) {
-			return string(data), nil
-		}
+		raw = true
 	} else if strings.HasSuffix(filename, "/html") {
-		// check if they want html
+		// check if they want html, which is sanitized or sandboxed so
+		// the scripts in pastes cannot run on this origin
+		switch cmd.htmlMode {
+		case htmlModeOff:
+			writeErrorStatus(w, http.StatusNotFound, "The html view of pastes is disabled")
+			return
+		case htmlModeSandbox:
+			csp = sandboxedCSP
+		default:
+			csp = sanitizedCSP
+			handler = sanitizeHTML
+		}
 		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 		filename = strings.TrimSuffix(filename, "/html")
-		handler = func(data []byte) (string, error) {
-			return string(data), nil
-		}
 	} else if strings.HasSuffix(filename, "/ansi") {
 		// check if they want ansi colored text
 		w.Header().Set("Content-Type", "text/html")
 		filename = strings.TrimSuffix(filename, "/ansi")
 		// try to syntax highlight the file
-		handler = func(data []byte) (string, error) {
-			return fmt.Sprintf("%s<pre><code>%s</code></pre>%s", htmlBegin, terminal.Render(data), htmlEnd), nil
+		handler = func(data []byte, meta *Metadata) (string, error) {
+			return htmlBegin + numberLines(string(terminal.Render(data)), "") + htmlEnd, nil
 		}
 	} else {
 		// check if they want html
 		w.Header().Set("Content-Type", "text/html")
-		handler = func(data []byte) (string, error) {
-			highlighted, err := syntaxhighlight.AsHTML(data)
-			if err != nil {
-				return "", err
+		handler = func(data []byte, meta *Metadata) (string, error) {
+			// binary pastes can only be downloaded
+			if !isText(meta) {
+				return fmt.Sprintf(`%s<p>%s (%s) cannot be shown here, <a href="%s%s/raw?download">download it</a>.</p>%s`, htmlBegin, html.EscapeString(contentName(meta)), html.EscapeString(meta.ContentType), baseuri, meta.ID, htmlEnd), nil
 			}
-			return fmt.Sprintf("%s<pre><code>%s</code></pre>%s", htmlBegin, string(highlighted), htmlEnd), nil
+			// highlight it in the language asked for, the one it was
+			// uploaded with or the one of its filename
+			return htmlBegin + highlight(data, r.URL.Query().Get("lang"), meta.Language, meta.Filename) + htmlEnd, nil
+		}
+	}
+
+	// get the paste from the store
+	if !validID(filename) {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("No such file or directory: %s", r.URL.Path))
+		return
+	}
+	// raw pastes stored with gzip can be sent as they are to clients
+	// that accept it, rather than decompressing them
+	var (
+		rc      io.ReadCloser
+		meta    *Metadata
+		gzipped bool
+		err     error
+	)
+	if es, ok := cmd.store.(encodedStore); ok && raw && acceptsGzip(r) {
+		rc, meta, gzipped, err = es.GetEncoded(filename, compressionGzip)
+	} else {
+		rc, meta, err = cmd.store.Get(filename)
+	}
+	if err == errPasteNotFound {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("No such file or directory: %s", r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("Reading file %s failed: %v", filename, err))
+		return
+	}
+	defer rc.Close()
+
+	if !cmd.authorizeRead(w, r, meta) {
+		return
+	}
+
+	if expired(meta) {
+		writeErrorStatus(w, http.StatusGone, fmt.Sprintf("Paste %s has expired", filename))
+		return
+	}
+
+	if !cmd.authorizePassword(w, r, meta, raw) {
+		return
+	}
+
+	if meta.Burn {
+		// browsers have to confirm they want to view it, anything else
+		// viewing the raw paste burns it straight away
+		if !((raw && r.Method == "GET") || r.Method == "POST") {
+			writeBurnConfirm(w)
+			return
 		}
+
+		// read it before it is deleted from the store
+		src, err := ioutil.ReadAll(rc)
+		if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("Reading file %s failed: %v", filename, err))
+			return
+		}
+		if err := cmd.burn(filename); err == errPasteNotFound {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("No such file or directory: %s", r.URL.Path))
+			return
+		} else if err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("Burning paste %s failed: %v", filename, err))
+			return
+		}
+		logrus.Infof("paste %q burned after reading", filename)
+
+		w.Header().Set("Cache-Control", "no-store")
+		rc = ioutil.NopCloser(bytes.NewReader(src))
 	}
 
-	// check if the file exists
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		writeError(w, fmt.Sprintf("No such file or directory: %s", r.URL.Path))
+	// end-to-end encrypted pastes can only be decrypted by the browser
+	if meta.Encrypted {
+		if raw {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+			// the decrypt page only shows the paste as text,
+			// but needs its script to do it
+			csp = ""
+			handler = decryptPage
+		}
+	}
+	if len(csp) > 0 {
+		w.Header().Set("Content-Security-Policy", csp)
+	}
+
+	// stream the raw views straight from the store
+	if handler == nil {
+		if raw {
+			w.Header().Add("Vary", "Accept-Encoding")
+			_, download := r.URL.Query()["download"]
+			w.Header().Set("Content-Disposition", contentDisposition(meta, download))
+		}
+		if gzipped {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		if _, err := io.Copy(w, rc); err != nil {
+			logrus.Warnf("serving paste %s failed: %v", filename, err)
+		}
 		return
 	}
 
-	// read the file
-	src, err := ioutil.ReadFile(filename)
+	src, err := ioutil.ReadAll(rc)
 	if err != nil {
-		writeError(w, fmt.Sprintf("Reading file %s failed: %v", filename, err))
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("Reading file %s failed: %v", filename, err))
 		return
 	}
 
-	data, err := handler(src)
+	data, err := handler(src, meta)
 	if err != nil {
 		writeError(w, fmt.Sprintf("Processing file %s failed: %v", filename, err))
+		return
 	}
 
 	io.WriteString(w, data)
@@ -235,14 +502,12 @@ func (cmd *serverCommand) pasteHandler(w http.ResponseWriter, r *http.Request) {
 
 // pasteUploadHander is the request handler for /paste
 // it creates a uuid for the paste and saves the contents of
-// the paste to that file.
+// the paste to the store.
 func (cmd *serverCommand) pasteUploadHandler(w http.ResponseWriter, r *http.Request) {
-	// check basic auth
-	u, p, ok := r.BasicAuth()
-	if (u != username || p != password) || !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="`+baseuri+`"`)
-		w.WriteHeader(401)
-		w.Write([]byte("401 Unauthorized\n"))
+	// check basic auth or the token
+	u, ok := cmd.authenticate(r, scopeUpload)
+	if !ok {
+		writeUnauthorized(w)
 		return
 	}
 
@@ -253,60 +518,229 @@ func (cmd *serverCommand) pasteUploadHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// read the body of the paste
-	content, err := ioutil.ReadAll(r.Body)
+	// refuse pastes we know are too large before reading them,
+	// compressed ones are checked as they are decompressed
+	encoding := r.Header.Get("Content-Encoding")
+	if c, _ := contentCompression(encoding); cmd.maxSize > 0 && r.ContentLength > cmd.maxSize && c == compressionNone {
+		writeErrorStatus(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("paste is larger than the maximum size of %d bytes", cmd.maxSize))
+		return
+	}
+
+	body, err := decodeBody(r.Body, encoding)
+	if err == errUnsupportedEncoding {
+		writeErrorStatus(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content encoding %q", encoding))
+		return
+	}
 	if err != nil {
-		writeError(w, fmt.Sprintf("reading from body failed: %v", err))
+		writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("decoding body failed: %v", err))
 		return
 	}
+	defer body.Close()
 
-	// create a unique id for the paste
-	id, err := uuid()
+	meta, err := cmd.pasteOptions(r, u)
 	if err != nil {
-		writeError(w, fmt.Sprintf("uuid generation failed: %v", err))
+		writeError(w, err.Error())
 		return
 	}
 
-	// write to file
-	file := filepath.Join(cmd.storage, id)
-	if err := ioutil.WriteFile(file, content, 0755); err != nil {
-		writeError(w, fmt.Sprintf("writing file to %q failed: %v", file, err))
+	resp, ok := cmd.storePaste(w, body, meta)
+	if !ok {
 		return
 	}
+	fmt.Fprint(w, resp)
+}
 
-	// serve the uri for the paste to the requester
-	fmt.Fprint(w, JSONResponse{
-		"uri": baseuri + id,
-	})
-	logrus.Infof("paste %q posted successfully", id)
+// pasteOptions returns the metadata for a new paste of the user from
+// the options in the query and headers of the request.
+func (cmd *serverCommand) pasteOptions(r *http.Request, u *user) (*Metadata, error) {
+	// work out when the paste expires
+	expires, err := cmd.expiresAt(r.URL.Query().Get("expire"))
+	if err != nil {
+		return nil, err
+	}
+
+	burn, _ := strconv.ParseBool(r.URL.Query().Get("burn"))
+	encrypted, _ := strconv.ParseBool(r.URL.Query().Get("encrypted"))
+
+	visibility := r.URL.Query().Get("visibility")
+	if len(visibility) < 1 {
+		visibility = visibilityPublic
+	}
+	if !validVisibility(visibility) {
+		return nil, fmt.Errorf("unknown visibility %q", visibility)
+	}
+
+	// hash the password of the paste
+	var passwordHash string
+	if pass := r.Header.Get(pastePasswordHeader); len(pass) > 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("hashing password failed: %v", err)
+		}
+		passwordHash = string(hash)
+	}
+
+	// authenticated users can ask for a vanity slug as the id
+	slug := r.URL.Query().Get("slug")
+	if len(slug) > 0 {
+		if err := validSlug(slug); err != nil {
+			return nil, err
+		}
+	}
+
+	// what was pasted, as far as the client knows
+	lang, err := parseLanguage(r.URL.Query().Get("lang"))
+	if err != nil {
+		return nil, err
+	}
+	var contentType string
+	if t := r.URL.Query().Get("type"); len(t) > 0 {
+		if contentType, err = parseContentType(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Metadata{
+		ID:           slug,
+		Created:      time.Now().UTC(),
+		Owner:        u.name,
+		Filename:     cleanFilename(r.URL.Query().Get("filename")),
+		Language:     lang,
+		ContentType:  contentType,
+		Expires:      expires,
+		Burn:         burn,
+		Visibility:   visibility,
+		PasswordHash: passwordHash,
+		Encrypted:    encrypted,
+	}, nil
 }
 
-// uuid generates a uuid for the paste.
-// This really does not need to be perfect.
-func uuid() (string, error) {
-	var chars = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
-
-	length := 8
-	b := make([]byte, length)
-	r := make([]byte, length+(length/4))
-	maxrb := 256 - (256 % len(chars))
-	i := 0
-	for {
-		if _, err := io.ReadFull(rand.Reader, r); err != nil {
-			return "", err
+// contentCompression returns the compression of the content encoding,
+// or false if the server cannot decode it.
+func contentCompression(encoding string) (string, bool) {
+	switch encoding {
+	case "", "identity":
+		return compressionNone, true
+	case compressionGzip, "x-gzip":
+		return compressionGzip, true
+	case compressionZstd:
+		return compressionZstd, true
+	default:
+		return "", false
+	}
+}
+
+// decodeBody returns a reader of the body decoded from the content
+// encoding. The size limit is applied to what it returns, so
+// compressed pastes cannot get around it.
+func decodeBody(body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	c, ok := contentCompression(encoding)
+	if !ok {
+		return nil, errUnsupportedEncoding
+	}
+	if c == compressionNone {
+		return body, nil
+	}
+	return decompressReader(body, c)
+}
+
+// storePaste streams the content to the store as a new paste with the
+// metadata and returns the response with its uri. If it fails the error
+// is written to the requester and false is returned.
+func (cmd *serverCommand) storePaste(w http.ResponseWriter, content io.Reader, meta *Metadata) (JSONResponse, bool) {
+	// a generated id can turn out to be taken only once the store gets
+	// to it, if another server stored a paste with it in the meantime,
+	// so keep what the store read to store it again with another id
+	slug := meta.ID
+	var replay *replayReader
+	if len(slug) < 1 {
+		replay = &replayReader{r: content}
+		defer replay.Close()
+	}
+
+	for attempt := 1; ; attempt++ {
+		// reserve the slug the paste asked for or a new unique id,
+		// so no other paste can be stored with it in the meantime
+		id, err := cmd.reserveID(slug)
+		if err == errIDTaken {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("paste id %s is already taken", slug))
+			return nil, false
+		}
+		if err != nil {
+			writeError(w, fmt.Sprintf("reserving paste id failed: %v", err))
+			return nil, false
+		}
+
+		m := *meta
+		m.ID = id
+		r := content
+		if replay != nil {
+			r = replay.replay()
+		}
+
+		// stream the paste to the store, counting its size on the way
+		// and working out whether it is text and its language
+		body := &sizeReader{r: r, max: cmd.maxSize, n: &m.Size}
+		r = body
+		if !m.Encrypted {
+			r = &sniffReader{r: body, meta: &m}
 		}
-		for _, rb := range r {
-			c := int(rb)
-			if c > maxrb {
-				continue
+		err = cmd.store.Put(id, r, &m)
+		cmd.reserved.release(id)
+		if err == errIDTaken && replay != nil && attempt < idAttempts {
+			logrus.Debugf("paste id %s was taken in the store, trying another one", id)
+			continue
+		}
+		if err == errIDTaken {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("paste id %s is already taken", id))
+			return nil, false
+		}
+		if err != nil {
+			if body.tooLarge() {
+				writeErrorStatus(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("paste is larger than the maximum size of %d bytes", cmd.maxSize))
+				return nil, false
 			}
-			b[i] = chars[c%len(chars)]
-			i++
-			if i == length {
-				return string(b), nil
+			writeError(w, fmt.Sprintf("storing paste %s failed: %v", id, err))
+			return nil, false
+		}
+		*meta = m
+		break
+	}
+
+	// serve the uri for the paste to the requester
+	resp := JSONResponse{
+		"uri": baseuri + meta.ID,
+	}
+	if !meta.Expires.IsZero() {
+		resp["expires"] = meta.Expires.Format(time.RFC3339)
+	}
+	logrus.Infof("paste %q posted successfully", meta.ID)
+	return resp, true
+}
+
+// acceptsGzip returns whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		// gzip;q=0 means it is not accepted
+		for _, p := range parts[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if f, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && f == 0 {
+					return false
+				}
 			}
 		}
+		return true
 	}
+	return false
+}
+
+// uuid generates a random id for api tokens and resumable uploads.
+func uuid() (string, error) {
+	return randomString(defaultIDAlphabet, 8)
 }
 
 // writeError sends an error back to the requester
@@ -318,3 +752,14 @@ func writeError(w http.ResponseWriter, msg string) {
 	})
 	logrus.Printf("writing error: %s", msg)
 }
+
+// writeErrorStatus sends an error with the http status code
+// back to the requester and also logs the error.
+func writeErrorStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, JSONResponse{
+		"error": msg,
+	})
+	logrus.Printf("writing error: %s", msg)
+}
@@ -0,0 +1,69 @@
+// Highlights the lines in #L<n> and #L<n>-L<m> fragments of the paste
+// views, and selects a range when a line number is shift-clicked.
+(function() {
+  'use strict';
+
+  var first = null;
+
+  function range() {
+    var m = /^#L(\d+)(?:-L(\d+))?$/.exec(window.location.hash);
+    if (!m) {
+      return null;
+    }
+    var start = parseInt(m[1], 10);
+    var end = m[2] ? parseInt(m[2], 10) : start;
+    return start <= end ? [start, end] : [end, start];
+  }
+
+  function highlight(scroll) {
+    var selected = document.querySelectorAll('.nl.selected');
+    for (var i = 0; i < selected.length; i++) {
+      selected[i].classList.remove('selected');
+    }
+
+    var r = range();
+    if (!r) {
+      return;
+    }
+    for (var n = r[0]; n <= r[1]; n++) {
+      var line = document.getElementById('L' + n);
+      if (line) {
+        line.classList.add('selected');
+      }
+    }
+
+    // ranges are not the id of an element, so scroll to them here
+    var start = document.getElementById('L' + r[0]);
+    if (scroll && start) {
+      start.scrollIntoView({block: 'center'});
+    }
+  }
+
+  document.addEventListener('click', function(e) {
+    var gutter = e.target.closest ? e.target.closest('a.gutter') : null;
+    if (!gutter) {
+      return;
+    }
+    var n = parseInt(gutter.getAttribute('data-line'), 10);
+    if (e.shiftKey && first !== null) {
+      e.preventDefault();
+      var start = Math.min(first, n);
+      var end = Math.max(first, n);
+      window.history.replaceState(null, '', start === end ? '#L' + start : '#L' + start + '-L' + end);
+      highlight(false);
+      return;
+    }
+    first = n;
+  });
+
+  window.addEventListener('hashchange', function() {
+    highlight(true);
+  });
+  document.addEventListener('DOMContentLoaded', function() {
+    var r = range();
+    if (r) {
+      first = r[0];
+    }
+    highlight(true);
+  });
+})();
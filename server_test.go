@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	// only show what went wrong
+	logrus.SetLevel(logrus.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server storing pastes in a temporary directory,
+// with the users admin, alice and bob whose passwords are their names.
+// Configure can change the server before its store is opened.
+func newTestServer(t *testing.T, configure func(cmd *serverCommand)) (*serverCommand, *httptest.Server) {
+	dir := t.TempDir()
+	cmd := &serverCommand{
+		storeConfig: storeConfig{
+			driver:      "filesystem",
+			storage:     filepath.Join(dir, "files"),
+			layout:      layoutFlat,
+			compression: compressionNone,
+		},
+		defaultExpire: "never",
+		maxExpire:     "never",
+		ids:           idGenerator{length: 8, alphabet: defaultIDAlphabet},
+		authMode:      authModeAll,
+		htmlMode:      htmlModeSanitize,
+		users:         map[string]*user{},
+		cookieKey:     make([]byte, 32),
+	}
+	for _, name := range []string{"admin", "alice", "bob"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(name), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.users[name] = &user{name: name, hash: hash, admin: name == "admin"}
+	}
+
+	var err error
+	if cmd.tokens, err = loadTokens(filepath.Join(dir, "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.uploads, err = newUploadStore(filepath.Join(dir, "uploads")); err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(cmd)
+	}
+	if cmd.store, err = cmd.storeConfig.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(cmd.handler())
+	t.Cleanup(srv.Close)
+	old := baseuri
+	baseuri = srv.URL + "/"
+	t.Cleanup(func() { baseuri = old })
+	return cmd, srv
+}
+
+// newTestRequest returns a request to the server, authenticated
+// as the user if there is one.
+func newTestRequest(t *testing.T, method, url, user string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user) > 0 {
+		req.SetBasicAuth(user, user)
+	}
+	return req
+}
+
+// doTestRequest sends the request and returns the response with its body.
+func doTestRequest(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// postTestPaste uploads the paste as the user with the query and returns
+// its id, failing the test if the upload fails.
+func postTestPaste(t *testing.T, srv *httptest.Server, user, query, content string) string {
+	t.Helper()
+	resp, body := doTestRequest(t, newTestRequest(t, "POST", srv.URL+"/paste?"+query, user, strings.NewReader(content)))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("uploading paste returned %s: %s", resp.Status, body)
+	}
+	var r struct{ URI string }
+	if err := json.Unmarshal([]byte(body), &r); err != nil {
+		t.Fatalf("parsing upload response %q failed: %v", body, err)
+	}
+	return path.Base(r.URI)
+}
+
+// takenStore fails the first puts with errIDTaken after reading some of
+// the contents, like a store finding the id taken by another server.
+type takenStore struct {
+	Store
+	taken int
+	ids   []string
+}
+
+func (s *takenStore) Put(id string, r io.Reader, meta *Metadata) error {
+	s.ids = append(s.ids, id)
+	if s.taken > 0 {
+		s.taken--
+		io.CopyN(ioutil.Discard, r, 3)
+		return errIDTaken
+	}
+	return s.Store.Put(id, r, meta)
+}
+
+func TestStorePasteIDTaken(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		slug   string
+		taken  int
+		status int
+	}{
+		{"generated id", "", 2, http.StatusOK},
+		{"generated ids all taken", "", idAttempts, http.StatusConflict},
+		{"slug", "myslug", 1, http.StatusConflict},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &takenStore{Store: testDrivers(t)["filesystem"], taken: tc.taken}
+			cmd := &serverCommand{store: s, ids: idGenerator{length: 8, alphabet: defaultIDAlphabet}}
+
+			w := httptest.NewRecorder()
+			meta := &Metadata{ID: tc.slug}
+			_, ok := cmd.storePaste(w, strings.NewReader("hello world"), meta)
+			if w.Code != tc.status {
+				t.Fatalf("storing the paste returned %d, expected %d: %s", w.Code, tc.status, w.Body)
+			}
+			if !ok {
+				return
+			}
+
+			if len(s.ids) != tc.taken+1 || s.ids[0] == s.ids[len(s.ids)-1] {
+				t.Fatalf("stored with the ids %v, expected %d different ones", s.ids, tc.taken+1)
+			}
+			if meta.ID != s.ids[len(s.ids)-1] || meta.Size != 11 {
+				t.Fatalf("metadata is %+v, expected the last id and a size of 11", meta)
+			}
+			if got := readPaste(t, s, meta.ID); got != "hello world" {
+				t.Fatalf("paste is %q after retrying, expected hello world", got)
+			}
+		})
+	}
+}
+
+func TestUploadCompressed(t *testing.T) {
+	const maxSize = 1 << 10
+	compress := map[string]func(b []byte) []byte{
+		"gzip": func(b []byte) []byte {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(b)
+			zw.Close()
+			return buf.Bytes()
+		},
+		"zstd": func(b []byte) []byte {
+			zw, _ := zstd.NewWriter(nil)
+			defer zw.Close()
+			return zw.EncodeAll(b, nil)
+		},
+		"identity": func(b []byte) []byte { return b },
+	}
+
+	for encoding, fn := range compress {
+		t.Run(encoding, func(t *testing.T) {
+			cmd, srv := newTestServer(t, func(cmd *serverCommand) { cmd.maxSize = maxSize })
+
+			// a paste within the limit is stored decompressed
+			req := newTestRequest(t, "POST", srv.URL+"/paste", "alice", bytes.NewReader(fn([]byte("hello world"))))
+			req.Header.Set("Content-Encoding", encoding)
+			resp, body := doTestRequest(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("uploading a small paste returned %s: %s", resp.Status, body)
+			}
+			pastes, err := cmd.store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pastes) != 1 {
+				t.Fatalf("%d pastes stored, expected 1", len(pastes))
+			}
+			if got := readPaste(t, cmd.store, pastes[0].ID); got != "hello world" {
+				t.Fatalf("paste is %q, expected hello world", got)
+			}
+
+			// a bomb that is small compressed is refused once it is
+			// larger than the limit decompressed
+			bomb := fn(make([]byte, 64*maxSize))
+			req = newTestRequest(t, "POST", srv.URL+"/paste", "alice", bytes.NewReader(bomb))
+			req.Header.Set("Content-Encoding", encoding)
+			resp, body = doTestRequest(t, req)
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("uploading %d bytes of %s returned %s, expected 413: %s", len(bomb), encoding, resp.Status, body)
+			}
+			if pastes, err := cmd.store.List(); err != nil || len(pastes) != 1 {
+				t.Fatalf("%d pastes stored after a refused upload (%v), expected 1", len(pastes), err)
+			}
+		})
+	}
+}
+
+func TestUploadUnsupportedEncoding(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	req := newTestRequest(t, "POST", srv.URL+"/paste", "alice", strings.NewReader("hello"))
+	req.Header.Set("Content-Encoding", "br")
+	resp, body := doTestRequest(t, req)
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("uploading a br paste returned %s, expected 415: %s", resp.Status, body)
+	}
+	if pastes, err := cmd.store.List(); err != nil || len(pastes) != 0 {
+		t.Fatalf("%d pastes stored after a refused upload (%v), expected none", len(pastes), err)
+	}
+}
+
+func TestServeGzipped(t *testing.T) {
+	content := strings.Repeat("hello compressed world\n", 100)
+	for _, compression := range []string{compressionGzip, compressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			_, srv := newTestServer(t, func(cmd *serverCommand) { cmd.storeConfig.compression = compression })
+			id := postTestPaste(t, srv, "alice", "", content)
+
+			for _, tc := range []struct {
+				accept string
+				gzip   bool
+			}{
+				{"", false},
+				{"gzip", compression == compressionGzip},
+				{"br, gzip;q=0.5", compression == compressionGzip},
+				{"gzip;q=0", false},
+				{"zstd", false},
+			} {
+				req := newTestRequest(t, "GET", srv.URL+"/"+id+"/raw", "", nil)
+				if len(tc.accept) > 0 {
+					req.Header.Set("Accept-Encoding", tc.accept)
+				}
+				resp, body := doTestRequest(t, req)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("getting paste returned %s: %s", resp.Status, body)
+				}
+				if !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+					t.Fatalf("paste is served with Vary %q, expected Accept-Encoding", resp.Header.Get("Vary"))
+				}
+
+				if got := resp.Header.Get("Content-Encoding"); (got == "gzip") != tc.gzip {
+					t.Fatalf("paste stored with %s is served to Accept-Encoding %q with Content-Encoding %q", compression, tc.accept, got)
+				}
+				if tc.gzip {
+					zr, err := gzip.NewReader(strings.NewReader(body))
+					if err != nil {
+						t.Fatal(err)
+					}
+					b, err := ioutil.ReadAll(zr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = string(b)
+				}
+				if body != content {
+					t.Fatalf("paste served to Accept-Encoding %q is %q, expected the contents", tc.accept, body)
+				}
+			}
+		})
+	}
+}
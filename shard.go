@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shard moves the pastes in the filesystem storage directory that are in
+// the other layout into the --storage-layout, in place. Pastes are found
+// in either layout while it runs, so the server can keep serving them.
+func (cmd *serverCommand) shard() error {
+	s, ok := findFilesystemStore(cmd.store)
+	if !ok {
+		return errors.New("shard needs the filesystem --storage-driver")
+	}
+
+	n, err := s.reshard()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("moved %d pastes in %s to the %s layout", n, s.dir, cmd.storeConfig.layout)
+	return nil
+}
+
+// findFilesystemStore returns the filesystemStore among the stores
+// wrapped by s.
+func findFilesystemStore(s Store) (*filesystemStore, bool) {
+	for _, s := range unwrapStore(s) {
+		if fs, ok := s.(*filesystemStore); ok {
+			return fs, true
+		}
+	}
+	return nil, false
+}
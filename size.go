@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// errTooLarge is returned by a sizeReader when its limit is exceeded.
+var errTooLarge = errors.New("paste is too large")
+
+// parseSize parses a size like 512K, 10MB or 1G into bytes.
+// Zero means no limit.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+
+	unit := int64(1)
+	num := strings.ToUpper(strings.TrimSpace(s))
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num = strings.TrimSuffix(num, u.suffix)
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/unit {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// sizeReader counts the bytes read from r into n, which can point at
+// the size in the metadata of the paste being stored, and fails with
+// errTooLarge once more than max bytes have been read, unless max is zero.
+type sizeReader struct {
+	r   io.Reader
+	max int64
+	n   *int64
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	*s.n += int64(n)
+	if s.tooLarge() {
+		return 0, errTooLarge
+	}
+	return n, err
+}
+
+// tooLarge returns whether the limit was exceeded.
+func (s *sizeReader) tooLarge() bool {
+	return s.max > 0 && *s.n > s.max
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// errPasteNotFound is returned by a Store when the paste does not exist.
+	errPasteNotFound = errors.New("paste not found")
+)
+
+// Metadata holds the information kept alongside the contents of a paste.
+type Metadata struct {
+	ID           string    `json:"id"`
+	Size         int64     `json:"size"`
+	Created      time.Time `json:"created"`
+	Owner        string    `json:"owner,omitempty"`
+	Filename     string    `json:"filename,omitempty"`
+	Language     string    `json:"language,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Binary       bool      `json:"binary,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+	Burn         bool      `json:"burn,omitempty"`
+	Visibility   string    `json:"visibility,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Encrypted    bool      `json:"encrypted,omitempty"`
+
+	// EncryptionKey is the id of the key the paste is encrypted
+	// with at rest, empty if it is not.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+
+	// Blob is the hash of the blob with the contents of the paste, or
+	// their HMAC if it is encrypted at rest, empty if it has its own. Refs is the number of pastes
+	// referencing a blob.
+	Blob string `json:"blob,omitempty"`
+	Refs int    `json:"refs,omitempty"`
+
+	// Compression is how the contents are compressed at rest,
+	// empty if they are not.
+	Compression string `json:"compression,omitempty"`
+
+	// SHA256 is the hash of the contents as they are stored,
+	// to detect corruption.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Store is the interface implemented by the paste storage backends.
+//
+// Put and Replace persist meta only after r has been read to EOF, so
+// callers can fill in fields like the size while the contents are being
+// streamed.
+type Store interface {
+	// Put stores the contents of r and meta as a new paste under id. It
+	// returns errIDTaken if there is a paste with the id already, even if
+	// it is being stored by another server at the same time.
+	Put(id string, r io.Reader, meta *Metadata) error
+	// Replace is like Put, but replaces the paste if it exists.
+	Replace(id string, r io.Reader, meta *Metadata) error
+	// Get returns the contents and metadata of the paste. The caller must
+	// close the returned reader.
+	Get(id string) (io.ReadCloser, *Metadata, error)
+	// Stat returns the metadata of the paste.
+	Stat(id string) (*Metadata, error)
+	// SetMetadata replaces the metadata of an existing paste.
+	SetMetadata(meta *Metadata) error
+	// List returns the metadata of all the pastes, sorted by id.
+	List() ([]*Metadata, error)
+	// Delete removes the paste and its metadata. It returns
+	// errPasteNotFound if there is no paste with the id, and to all but
+	// one of the deletes of a paste at the same time.
+	Delete(id string) error
+}
+
+// putFunc is the signature of Put and Replace.
+type putFunc func(id string, r io.Reader, meta *Metadata) error
+
+// wrapper is implemented by the stores that wrap another store.
+type wrapper interface {
+	unwrap() Store
+}
+
+// unwrapStore returns s and all the stores it wraps, outermost first.
+func unwrapStore(s Store) []Store {
+	stores := []Store{s}
+	for {
+		w, ok := s.(wrapper)
+		if !ok {
+			return stores
+		}
+		s = w.unwrap()
+		stores = append(stores, s)
+	}
+}
+
+// storeConfig holds the flags used to select and configure a Store.
+type storeConfig struct {
+	driver  string
+	storage string
+	layout  string
+	dbPath  string
+
+	s3Endpoint  string
+	s3Region    string
+	s3Bucket    string
+	s3Prefix    string
+	s3PathStyle bool
+
+	compression       string
+	encryptionKeyFile string
+	dedup             bool
+}
+
+// register adds the storage flags to the flagset.
+func (c *storeConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.driver, "storage-driver", "filesystem", "storage driver to use for pastes (filesystem, db, s3)")
+
+	fs.StringVar(&c.storage, "s", "/etc/pastebinit/files", "directory to store pastes")
+	fs.StringVar(&c.storage, "storage", "/etc/pastebinit/files", "directory to store pastes")
+	fs.StringVar(&c.layout, "storage-layout", layoutFlat, "layout of the filesystem storage directory (flat, sharded)")
+
+	fs.StringVar(&c.dbPath, "db-path", "/etc/pastebinit/pastes.db", "path to the database file for the db storage driver")
+
+	region := os.Getenv("AWS_REGION")
+	if len(region) < 1 {
+		region = "us-east-1"
+	}
+	fs.StringVar(&c.s3Endpoint, "s3-endpoint", "", "endpoint of the S3 API for the s3 storage driver, AWS if empty")
+	fs.StringVar(&c.s3Region, "s3-region", region, "region of the bucket for the s3 storage driver (or env var AWS_REGION)")
+	fs.StringVar(&c.s3Bucket, "s3-bucket", "", "bucket to store pastes in for the s3 storage driver")
+	fs.StringVar(&c.s3Prefix, "s3-prefix", "", "prefix for the object keys for the s3 storage driver")
+	fs.BoolVar(&c.s3PathStyle, "s3-path-style", false, "use path style addressing for the s3 storage driver")
+
+	fs.StringVar(&c.compression, "compression", compressionNone, "compression for the pastes at rest (none, gzip, zstd)")
+	fs.StringVar(&c.encryptionKeyFile, "encryption-key-file", "", "file of id:secret keys to encrypt pastes at rest with, the first one is used for new pastes")
+	fs.BoolVar(&c.dedup, "dedup", false, "store pastes with the same contents once, only safe with a single server using the storage")
+}
+
+// open returns the Store for the configured driver.
+func (c *storeConfig) open() (Store, error) {
+	var (
+		s   Store
+		err error
+	)
+	switch c.driver {
+	case "filesystem", "fs":
+		s, err = newFilesystemStore(c.storage, c.layout)
+	case "db":
+		s, err = newDBStore(c.dbPath)
+	case "s3":
+		s, err = newS3Store(c.s3Endpoint, c.s3Region, c.s3Bucket, c.s3Prefix, c.s3PathStyle)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", c.driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(s)
+}
+
+// wrap returns the store with the deduplication, compression and
+// encryption at rest of the flags, and the checksums of what is stored.
+// The contents are compressed before they are encrypted. Without an
+// --encryption-key-file new pastes are not encrypted, but reading pastes
+// that are fails rather than returning the ciphertext.
+func (c *storeConfig) wrap(s Store) (Store, error) {
+	if !validCompression(c.compression) {
+		return nil, fmt.Errorf("unknown compression %q", c.compression)
+	}
+
+	es := &encryptedStore{Store: &checksumStore{Store: s}}
+	ds := &dedupStore{Store: &compressedStore{Store: es, compression: c.compression}, enabled: c.dedup}
+	if len(c.encryptionKeyFile) > 0 {
+		var err error
+		if es.keys, es.primary, ds.key, err = loadEncryptionKeys(c.encryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+// validID returns whether the id is safe to be used as a paste id.
+func validID(id string) bool {
+	if len(id) < 1 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// copyStore copies all the pastes that do not already exist in dst
+// from src, returning the number of pastes copied.
+func copyStore(dst, src Store) (int, error) {
+	pastes, err := src.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, p := range pastes {
+		if _, err := dst.Stat(p.ID); err == nil {
+			continue
+		}
+
+		rc, meta, err := src.Get(p.ID)
+		if err != nil {
+			return n, fmt.Errorf("reading paste %s failed: %v", p.ID, err)
+		}
+		err = dst.Put(p.ID, rc, meta)
+		rc.Close()
+		if err == errIDTaken {
+			// stored by someone else since it was checked
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("writing paste %s failed: %v", p.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// checksumStore records the sha256 of the contents of the pastes as they
+// are stored in the wrapped store, and checks it when they are read so
+// corrupted pastes are not served. The whole contents are checked before
+// Get returns, so an error can still be sent instead of them. Pastes from
+// before checksums were stored are returned as is.
+type checksumStore struct {
+	Store
+}
+
+func (s *checksumStore) unwrap() Store {
+	return s.Store
+}
+
+func (s *checksumStore) Put(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Put, id, r, meta)
+}
+
+func (s *checksumStore) Replace(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Replace, id, r, meta)
+}
+
+func (s *checksumStore) put(put putFunc, id string, r io.Reader, meta *Metadata) error {
+	// the wrapped store reads r to EOF before it persists meta,
+	// so the sum is filled in by then.
+	meta.SHA256 = ""
+	return put(id, &checksumReader{r: r, h: sha256.New(), meta: meta}, meta)
+}
+
+func (s *checksumStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	rc, meta, err := s.Store.Get(id)
+	if err != nil || len(meta.SHA256) < 1 {
+		return rc, meta, err
+	}
+
+	// check the whole contents up front and read them again after, from
+	// a temporary file they are spooled to if the reader cannot seek.
+	rs, ok := rc.(io.ReadSeeker)
+	if !ok {
+		tmp, err := spool(rc)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc, rs = tmp, tmp
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	if err := checkSum(id, h, meta.SHA256); err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return rc, meta, nil
+}
+
+// tempFile is a temporary file that is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	defer os.Remove(f.Name())
+	return f.File.Close()
+}
+
+// spool copies the contents of rc to a temporary file and closes rc,
+// returning the file at its start.
+func spool(rc io.ReadCloser) (*tempFile, error) {
+	defer rc.Close()
+
+	f, err := ioutil.TempFile("", "pastebinit-spool-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{f}
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// checkSum returns an error if the sum of the contents of the paste
+// is not the stored one.
+func checkSum(id string, h hash.Hash, sum string) error {
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("paste %s is corrupted: its sha256 is %s instead of %s", id, got, sum)
+	}
+	return nil
+}
+
+// checksumReader sets the sha256 of the metadata to the
+// sum of the contents once they are read.
+type checksumReader struct {
+	r    io.Reader
+	h    hash.Hash
+	meta *Metadata
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF {
+		c.meta.SHA256 = hex.EncodeToString(c.h.Sum(nil))
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// streamStore returns the contents of the wrapped store
+// from readers that cannot seek, like the s3 driver does.
+type streamStore struct {
+	Store
+}
+
+type streamReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *streamStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	rc, meta, err := s.Store.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return streamReader{rc, rc}, meta, nil
+}
+
+func TestChecksumStore(t *testing.T) {
+	stores := testDrivers(t)
+	stores["stream"] = &streamStore{Store: testDrivers(t)["db"]}
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			cs := &checksumStore{Store: s}
+			if err := cs.Put("paste", strings.NewReader("hello world"), &Metadata{ID: "paste"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readPaste(t, cs, "paste"); got != "hello world" {
+				t.Fatalf("paste is %q, expected hello world", got)
+			}
+
+			// corrupt it below the checksums, keeping the metadata
+			meta, err := s.Stat("paste")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Replace("paste", strings.NewReader("HELLO WORLD"), meta); err != nil {
+				t.Fatal(err)
+			}
+
+			rc, _, err := cs.Get("paste")
+			if err == nil {
+				rc.Close()
+				t.Fatal("getting a corrupted paste did not fail")
+			}
+			if !strings.Contains(err.Error(), "corrupted") {
+				t.Fatalf("getting a corrupted paste failed with %v, expected it to be corrupted", err)
+			}
+		})
+	}
+}
+
+func TestChecksumStoreDBValue(t *testing.T) {
+	s := testDrivers(t)["db"].(*dbStore)
+	cs := &checksumStore{Store: s}
+	if err := cs.Put("paste", strings.NewReader("hello world"), &Metadata{ID: "paste"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip the value in the database itself
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pastesBucket).Put([]byte("paste"), []byte("HELLO WORLD"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cs.Get("paste"); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Fatalf("getting a corrupted paste returned %v, expected it to be corrupted", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// errUnsupportedEncoding is returned for uploads with a content
+// encoding the server cannot decode.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// validCompression returns whether c is a known compression.
+func validCompression(c string) bool {
+	return c == compressionNone || c == compressionGzip || c == compressionZstd
+}
+
+// encodedStore is implemented by the stores that can return the contents
+// of a paste as they are stored with a content encoding like gzip, so they
+// can be sent to clients that accept it without decoding them.
+type encodedStore interface {
+	// GetEncoded is like Get, but if the contents are stored with the
+	// encoding they are returned as is and true is returned.
+	GetEncoded(id, encoding string) (io.ReadCloser, *Metadata, bool, error)
+}
+
+// compressedStore compresses the contents of the pastes in the wrapped
+// store. Pastes are decompressed with whatever they were compressed with,
+// so the compression of new pastes can be changed at any time.
+type compressedStore struct {
+	Store
+
+	compression string
+}
+
+func (s *compressedStore) unwrap() Store {
+	return s.Store
+}
+
+func (s *compressedStore) Put(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Put, id, r, meta)
+}
+
+func (s *compressedStore) Replace(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Replace, id, r, meta)
+}
+
+func (s *compressedStore) put(put putFunc, id string, r io.Reader, meta *Metadata) error {
+	if s.compression == compressionNone {
+		meta.Compression = ""
+		return put(id, r, meta)
+	}
+	meta.Compression = s.compression
+
+	cr := compressReader(r, s.compression)
+	defer cr.Close()
+	return put(id, cr, meta)
+}
+
+func (s *compressedStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	rc, meta, _, err := s.GetEncoded(id, "")
+	return rc, meta, err
+}
+
+func (s *compressedStore) GetEncoded(id, encoding string) (io.ReadCloser, *Metadata, bool, error) {
+	rc, meta, err := s.Store.Get(id)
+	if err != nil || len(meta.Compression) < 1 {
+		return rc, meta, false, err
+	}
+	if meta.Compression == encoding {
+		return rc, meta, true, nil
+	}
+
+	dr, err := decompressReader(rc, meta.Compression)
+	if err != nil {
+		rc.Close()
+		return nil, nil, false, fmt.Errorf("decompressing paste %s failed: %v", id, err)
+	}
+	return dr, meta, false, nil
+}
+
+// compressingReader reads the contents of a reader as they are
+// compressed by a goroutine.
+type compressingReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// compressReader returns a reader of the contents of r compressed with
+// the compression. Closing it stops the compression if it is not done.
+func compressReader(r io.Reader, compression string) io.ReadCloser {
+	// the compressors are writers, so compress the contents
+	// through a pipe as they are read.
+	pr, pw := io.Pipe()
+	c := &compressingReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+
+		var (
+			cw  io.WriteCloser
+			err error
+		)
+		switch compression {
+		case compressionGzip:
+			cw = gzip.NewWriter(pw)
+		case compressionZstd:
+			cw, err = zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		default:
+			err = fmt.Errorf("unknown compression %q", compression)
+		}
+		if err == nil {
+			_, err = io.Copy(cw, r)
+			if cerr := cw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return c
+}
+
+func (c *compressingReader) Close() error {
+	c.PipeReader.CloseWithError(io.ErrClosedPipe)
+	<-c.done
+	return nil
+}
+
+// decompressReader returns a reader of the decompressed contents of rc.
+// Closing it closes rc.
+func decompressReader(rc io.ReadCloser, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case compressionGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressingReader{Reader: zr, close: rc.Close}, nil
+	case compressionZstd:
+		// cap the memory a crafted frame can make the decoder use
+		zr, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(64<<20))
+		if err != nil {
+			return nil, err
+		}
+		return &decompressingReader{Reader: zr, close: func() error {
+			zr.Close()
+			return rc.Close()
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// decompressingReader reads decompressed contents
+// and closes the underlying reader.
+type decompressingReader struct {
+	io.Reader
+	close func() error
+}
+
+func (d *decompressingReader) Close() error {
+	return d.close()
+}
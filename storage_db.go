@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	pastesBucket = []byte("pastes")
+	metaBucket   = []byte("meta")
+)
+
+// dbStore stores the pastes and their metadata in a single
+// embedded bolt database file.
+type dbStore struct {
+	db *bolt.DB
+}
+
+// newDBStore opens or creates the database at path and returns
+// a Store backed by it.
+func newDBStore(path string) (*dbStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening database %q failed: %v", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{pastesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating buckets in %q failed: %v", path, err)
+	}
+
+	return &dbStore{db: db}, nil
+}
+
+func (s *dbStore) Put(id string, r io.Reader, meta *Metadata) error {
+	return s.put(id, r, meta, true)
+}
+
+func (s *dbStore) Replace(id string, r io.Reader, meta *Metadata) error {
+	return s.put(id, r, meta, false)
+}
+
+// put stores the paste, failing with errIDTaken if it exists
+// and exclusive is true.
+func (s *dbStore) put(id string, r io.Reader, meta *Metadata, exclusive bool) error {
+	// bolt needs the whole value in memory for the write.
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// writes are serialized, so nothing can store
+		// the paste between the check and the put.
+		if exclusive && (tx.Bucket(metaBucket).Get([]byte(id)) != nil || tx.Bucket(pastesBucket).Get([]byte(id)) != nil) {
+			return errIDTaken
+		}
+		if err := tx.Bucket(pastesBucket).Put([]byte(id), content); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put([]byte(id), m)
+	})
+}
+
+func (s *dbStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	var (
+		content []byte
+		meta    *Metadata
+	)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getMeta(tx, id)
+		if err != nil {
+			return err
+		}
+		// Values are only valid for the life of the transaction so copy it.
+		content = append([]byte{}, tx.Bucket(pastesBucket).Get([]byte(id))...)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return bytesReadCloser{bytes.NewReader(content)}, meta, nil
+}
+
+// bytesReadCloser is a reader of contents in memory that can be closed,
+// and can seek so their checksum is checked without copying them.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+func (s *dbStore) Stat(id string) (*Metadata, error) {
+	var meta *Metadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getMeta(tx, id)
+		return err
+	})
+	return meta, err
+}
+
+func (s *dbStore) SetMetadata(meta *Metadata) error {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(metaBucket).Get([]byte(meta.ID)) == nil {
+			return errPasteNotFound
+		}
+		return tx.Bucket(metaBucket).Put([]byte(meta.ID), m)
+	})
+}
+
+func (s *dbStore) List() ([]*Metadata, error) {
+	pastes := []*Metadata{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+			var meta Metadata
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return fmt.Errorf("parsing metadata for %s failed: %v", k, err)
+			}
+			pastes = append(pastes, &meta)
+			return nil
+		})
+	})
+	return pastes, err
+}
+
+func (s *dbStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(metaBucket).Get([]byte(id)) == nil {
+			return errPasteNotFound
+		}
+		if err := tx.Bucket(pastesBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Delete([]byte(id))
+	})
+}
+
+// getMeta returns the metadata for the paste from the transaction.
+func getMeta(tx *bolt.Tx, id string) (*Metadata, error) {
+	v := tx.Bucket(metaBucket).Get([]byte(id))
+	if v == nil {
+		return nil, errPasteNotFound
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(v, &meta); err != nil {
+		return nil, fmt.Errorf("parsing metadata for %s failed: %v", id, err)
+	}
+	return &meta, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobSuffix is the suffix of the ids of the blobs in the wrapped store.
+// It is not valid in paste ids, so blobs cannot be requested directly.
+const blobSuffix = ".blob"
+
+// blobAttempts is how many times storing a blob is tried while it is
+// being stored or deleted by other pastes at the same time.
+const blobAttempts = 10
+
+// dedupStore stores the contents of the pastes in the wrapped store once
+// per unique body, as blobs named by the sha256 of the contents, or by
+// their HMAC with the key when the pastes are encrypted at rest, so the
+// names do not tell what is in them. Pastes are stored with an empty body
+// and the hash of their blob in the metadata. Blobs count the pastes
+// referencing them and are deleted along with the last one.
+//
+// The reference counts are only safe with one server using the store, so
+// new pastes are only deduplicated if it is enabled. Blobs are still read
+// and released when it is not, for the pastes stored while it was.
+type dedupStore struct {
+	Store
+
+	enabled bool
+	key     []byte
+
+	// mu guards the reference counts.
+	mu sync.Mutex
+}
+
+func blobID(hash string) string {
+	return hash + blobSuffix
+}
+
+func (s *dedupStore) unwrap() Store {
+	return s.Store
+}
+
+func (s *dedupStore) Put(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Put, id, r, meta)
+}
+
+func (s *dedupStore) Replace(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Replace, id, r, meta)
+}
+
+func (s *dedupStore) put(put putFunc, id string, r io.Reader, meta *Metadata) error {
+	old, _ := s.Store.Stat(id)
+
+	if s.enabled {
+		hash, err := s.storeBlob(r)
+		if err != nil {
+			return err
+		}
+		meta.Blob = hash
+		r = bytes.NewReader(nil)
+	} else {
+		meta.Blob = ""
+	}
+
+	if err := put(id, r, meta); err != nil {
+		if len(meta.Blob) > 0 {
+			s.release(meta.Blob)
+		}
+		return err
+	}
+
+	// the paste was replaced, so drop its old blob
+	if old != nil && len(old.Blob) > 0 {
+		return s.release(old.Blob)
+	}
+	return nil
+}
+
+// storeBlob references the blob with the contents of r, storing it if
+// it is new, and returns its hash.
+func (s *dedupStore) storeBlob(r io.Reader) (string, error) {
+	// the blob is named by the hash of the contents, so spool them
+	// to a temporary file, hashing them on the way.
+	tmp, err := ioutil.TempFile("", "pastebinit-dedup-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if len(s.key) > 0 {
+		h = hmac.New(sha256.New, s.key)
+	}
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	for i := 0; i < blobAttempts; i++ {
+		if ok, err := s.reference(hash); err != nil || ok {
+			return hash, err
+		}
+
+		// store it without holding the lock, Put fails if another
+		// paste stored it in the meantime and it is referenced again
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		err := s.Store.Put(blobID(hash), tmp, &Metadata{
+			ID:      blobID(hash),
+			Size:    n,
+			Created: time.Now().UTC(),
+			Refs:    1,
+		})
+		if err == errIDTaken {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("storing blob %s failed: %v", hash, err)
+		}
+		return hash, nil
+	}
+	return "", fmt.Errorf("storing blob %s failed: it is being stored or deleted by another paste", hash)
+}
+
+// reference adds a reference to the blob, returning false if it does
+// not exist.
+func (s *dedupStore) reference(hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, err := s.Store.Stat(blobID(hash))
+	if err == errPasteNotFound {
+		return false, nil
+	}
+	if err == nil {
+		blob.Refs++
+		err = s.Store.SetMetadata(blob)
+	}
+	if err != nil {
+		return false, fmt.Errorf("referencing blob %s failed: %v", hash, err)
+	}
+	return true, nil
+}
+
+func (s *dedupStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	rc, meta, _, err := s.GetEncoded(id, "")
+	return rc, meta, err
+}
+
+func (s *dedupStore) GetEncoded(id, encoding string) (io.ReadCloser, *Metadata, bool, error) {
+	get := func(id string) (io.ReadCloser, *Metadata, bool, error) {
+		if es, ok := s.Store.(encodedStore); ok {
+			return es.GetEncoded(id, encoding)
+		}
+		rc, meta, err := s.Store.Get(id)
+		return rc, meta, false, err
+	}
+
+	rc, meta, encoded, err := get(id)
+	if err != nil || len(meta.Blob) < 1 {
+		// pastes from before deduplication have their own body
+		return rc, meta, encoded, err
+	}
+	rc.Close()
+
+	rc, _, encoded, err = get(blobID(meta.Blob))
+	if err == errPasteNotFound {
+		return nil, nil, false, fmt.Errorf("blob %s of paste %s is missing", meta.Blob, id)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return rc, meta, encoded, nil
+}
+
+func (s *dedupStore) List() ([]*Metadata, error) {
+	all, err := s.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	pastes := all[:0]
+	for _, meta := range all {
+		if !strings.HasSuffix(meta.ID, blobSuffix) {
+			pastes = append(pastes, meta)
+		}
+	}
+	return pastes, nil
+}
+
+func (s *dedupStore) Delete(id string) error {
+	meta, err := s.Store.Stat(id)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Delete(id); err != nil {
+		return err
+	}
+	if len(meta.Blob) > 0 {
+		return s.release(meta.Blob)
+	}
+	return nil
+}
+
+// release drops a reference to the blob, deleting it if it was the
+// last one.
+func (s *dedupStore) release(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, err := s.Store.Stat(blobID(hash))
+	if err != nil {
+		return fmt.Errorf("releasing blob %s failed: %v", hash, err)
+	}
+
+	blob.Refs--
+	if blob.Refs > 0 {
+		return s.Store.SetMetadata(blob)
+	}
+	return s.Store.Delete(blob.ID)
+}
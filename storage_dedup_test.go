@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blobs returns the blobs in the store below the dedupStore.
+func blobs(t *testing.T, s *dedupStore) []*Metadata {
+	t.Helper()
+	all, err := s.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blobs []*Metadata
+	for _, meta := range all {
+		if strings.HasSuffix(meta.ID, blobSuffix) {
+			blobs = append(blobs, meta)
+		}
+	}
+	return blobs
+}
+
+func TestDedupStore(t *testing.T) {
+	fs, err := newFilesystemStore(t.TempDir(), layoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dedupStore{Store: fs, enabled: true}
+
+	for _, id := range []string{"one", "two"} {
+		if err := s.Put(id, strings.NewReader("same"), &Metadata{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := blobs(t, s)
+	if len(b) != 1 || b[0].Refs != 2 {
+		t.Fatalf("expected one blob with 2 refs, got %+v", b)
+	}
+	sum := sha256.Sum256([]byte("same"))
+	if b[0].ID != blobID(hex.EncodeToString(sum[:])) {
+		t.Fatalf("blob is named %s, expected the sha256 of its contents", b[0].ID)
+	}
+
+	if err := s.Delete("one"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPaste(t, s, "two"); got != "same" {
+		t.Fatalf("paste is %q after deleting the other one, expected same", got)
+	}
+	if err := s.Delete("two"); err != nil {
+		t.Fatal(err)
+	}
+	if b := blobs(t, s); len(b) != 0 {
+		t.Fatalf("blobs are left after deleting all the pastes: %+v", b)
+	}
+}
+
+func TestDedupStoreDisabled(t *testing.T) {
+	fs, err := newFilesystemStore(t.TempDir(), layoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pastes stored while it was enabled are still read and released
+	enabled := &dedupStore{Store: fs, enabled: true}
+	if err := enabled.Put("old", strings.NewReader("same"), &Metadata{ID: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &dedupStore{Store: fs}
+	if err := s.Put("new", strings.NewReader("same"), &Metadata{ID: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if b := blobs(t, s); len(b) != 1 || b[0].Refs != 1 {
+		t.Fatalf("expected the one blob of the old paste, got %+v", b)
+	}
+	for _, id := range []string{"old", "new"} {
+		if got := readPaste(t, s, id); got != "same" {
+			t.Fatalf("paste %s is %q, expected same", id, got)
+		}
+	}
+
+	if err := s.Delete("old"); err != nil {
+		t.Fatal(err)
+	}
+	if b := blobs(t, s); len(b) != 0 {
+		t.Fatalf("the blob of the old paste is left after deleting it: %+v", b)
+	}
+}
+
+func TestDedupStoreKey(t *testing.T) {
+	fs, err := newFilesystemStore(t.TempDir(), layoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dedupStore{Store: fs, enabled: true, key: []byte("0123456789abcdef0123456789abcdef")}
+
+	if err := s.Put("one", strings.NewReader("secret"), &Metadata{ID: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("secret"))
+	b := blobs(t, s)
+	if len(b) != 1 || b[0].ID == blobID(hex.EncodeToString(sum[:])) {
+		t.Fatalf("expected one blob not named by the sha256 of its contents, got %+v", b)
+	}
+}
+
+func TestDedupStoreConcurrent(t *testing.T) {
+	fs, err := newFilesystemStore(t.TempDir(), layoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dedupStore{Store: fs, enabled: true}
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			errs <- s.Put(id, strings.NewReader("same"), &Metadata{ID: id})
+		}(fmt.Sprintf("paste%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b := blobs(t, s); len(b) != 1 || b[0].Refs != n {
+		t.Fatalf("expected one blob with %d refs, got %+v", n, b)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// encryptionVersion is the first byte of every paste encrypted at rest.
+	encryptionVersion = 1
+	// encryptionChunkSize is the size of the plaintext chunks that are
+	// sealed separately, so pastes can be streamed.
+	encryptionChunkSize = 64 * 1024
+	// noncePrefixSize is the size of the random part of the chunk nonces,
+	// the rest is the chunk counter and the last chunk flag.
+	noncePrefixSize = 7
+)
+
+// encryptedStore encrypts the contents of the pastes in the wrapped store
+// with AES-GCM. The metadata is left as is, apart from the id of the key
+// the paste was encrypted with.
+//
+// The contents are split into chunks that are sealed with a nonce made of
+// a random prefix, the chunk counter and a flag marking the last chunk, so
+// chunks cannot be reordered or dropped. The paste id is the additional
+// data so the contents cannot be swapped between pastes.
+type encryptedStore struct {
+	Store
+
+	keys    map[string]cipher.AEAD
+	primary string
+}
+
+// loadEncryptionKeys reads the keys from a file with an id:secret line per
+// key. Secrets that are the base64 encoding of 32 bytes are used as the
+// key, anything else is a passphrase the key is derived from. New pastes
+// are encrypted with the first key, the others are only used to decrypt.
+// The key the blobs of new pastes are named with is derived from the
+// first key too.
+func loadEncryptionKeys(path string) (map[string]cipher.AEAD, string, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("opening encryption key file %q failed: %v", path, err)
+	}
+	defer f.Close()
+
+	keys := map[string]cipher.AEAD{}
+	primary := ""
+	var blobKey []byte
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || len(fields[0]) < 1 || len(fields[1]) < 1 {
+			return nil, "", nil, fmt.Errorf("%s:%d: expected id:secret", path, n)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, "", nil, fmt.Errorf("%s:%d: duplicate key id %q", path, n, fields[0])
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			key = make([]byte, 32)
+			if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(fields[1]), nil, []byte("pastebinit "+fields[0])), key); err != nil {
+				return nil, "", nil, err
+			}
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		keys[fields[0]] = aead
+		if len(primary) < 1 {
+			primary = fields[0]
+			blobKey = make([]byte, 32)
+			if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("pastebinit blobs")), blobKey); err != nil {
+				return nil, "", nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", nil, fmt.Errorf("reading encryption key file %q failed: %v", path, err)
+	}
+	if len(primary) < 1 {
+		return nil, "", nil, fmt.Errorf("encryption key file %q has no keys", path)
+	}
+
+	return keys, primary, blobKey, nil
+}
+
+func (s *encryptedStore) unwrap() Store {
+	return s.Store
+}
+
+func (s *encryptedStore) Put(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Put, id, r, meta)
+}
+
+func (s *encryptedStore) Replace(id string, r io.Reader, meta *Metadata) error {
+	return s.put(s.Store.Replace, id, r, meta)
+}
+
+func (s *encryptedStore) put(put putFunc, id string, r io.Reader, meta *Metadata) error {
+	meta.EncryptionKey = s.primary
+	if len(s.primary) < 1 {
+		return put(id, r, meta)
+	}
+
+	sr, err := newSealReader(r, s.keys[s.primary], id)
+	if err != nil {
+		return err
+	}
+	return put(id, sr, meta)
+}
+
+func (s *encryptedStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	rc, meta, err := s.Store.Get(id)
+	if err != nil || len(meta.EncryptionKey) < 1 {
+		return rc, meta, err
+	}
+
+	aead, ok := s.keys[meta.EncryptionKey]
+	if !ok {
+		rc.Close()
+		return nil, nil, fmt.Errorf("paste %s is encrypted with key %q which is not in the --encryption-key-file", id, meta.EncryptionKey)
+	}
+	or, err := newOpenReader(rc, aead, id)
+	if err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return or, meta, nil
+}
+
+// sealReader encrypts the contents of a reader as it is read.
+type sealReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	ad    []byte
+	nonce []byte
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+func newSealReader(r io.Reader, aead cipher.AEAD, id string) (*sealReader, error) {
+	s := &sealReader{
+		r:     bufio.NewReaderSize(r, encryptionChunkSize),
+		aead:  aead,
+		ad:    []byte(id),
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, encryptionChunkSize, encryptionChunkSize+aead.Overhead()),
+	}
+	if _, err := rand.Read(s.nonce[:noncePrefixSize]); err != nil {
+		return nil, err
+	}
+	// the header is the version and the nonce prefix
+	s.out = append([]byte{encryptionVersion}, s.nonce[:noncePrefixSize]...)
+	return s, nil
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.out) < 1 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// seal reads and encrypts the next chunk.
+func (s *sealReader) seal() error {
+	n, err := io.ReadFull(s.r, s.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		s.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := s.r.Peek(1); err == io.EOF {
+		s.done = true
+	} else if err != nil {
+		return err
+	}
+
+	if s.done {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	s.out = s.aead.Seal(s.buf[:0], s.nonce, s.buf[:n], s.ad)
+	return nextNonce(s.nonce)
+}
+
+// openReader decrypts the contents of a reader as it is read.
+type openReader struct {
+	r     *bufio.Reader
+	c     io.Closer
+	id    string
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+// newOpenReader reads the header and decrypts the first chunk straight
+// away, so a wrong key is an error before anything is served.
+func newOpenReader(rc io.ReadCloser, aead cipher.AEAD, id string) (*openReader, error) {
+	o := &openReader{
+		r:     bufio.NewReaderSize(rc, encryptionChunkSize+aead.Overhead()),
+		c:     rc,
+		id:    id,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, encryptionChunkSize+aead.Overhead()),
+	}
+
+	header := make([]byte, 1+noncePrefixSize)
+	if _, err := io.ReadFull(o.r, header); err != nil {
+		return nil, fmt.Errorf("reading encrypted paste %s failed: %v", id, err)
+	}
+	if header[0] != encryptionVersion {
+		return nil, fmt.Errorf("paste %s has unknown encryption version %d", id, header[0])
+	}
+	copy(o.nonce, header[1:])
+
+	if err := o.open(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) < 1 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (o *openReader) open() error {
+	n, err := io.ReadFull(o.r, o.buf)
+	if err == io.EOF {
+		return fmt.Errorf("decrypting paste %s failed: it is truncated", o.id)
+	} else if err == io.ErrUnexpectedEOF {
+		o.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := o.r.Peek(1); err == io.EOF {
+		o.done = true
+	} else if err != nil {
+		return err
+	}
+
+	if o.done {
+		o.nonce[len(o.nonce)-1] = 1
+	}
+	o.out, err = o.aead.Open(o.buf[:0], o.nonce, o.buf[:n], []byte(o.id))
+	if err != nil {
+		return fmt.Errorf("decrypting paste %s failed: %v", o.id, err)
+	}
+	return nextNonce(o.nonce)
+}
+
+func (o *openReader) Close() error {
+	return o.c.Close()
+}
+
+// nextNonce increments the chunk counter in the nonce.
+func nextNonce(nonce []byte) error {
+	counter := nonce[noncePrefixSize : len(nonce)-1]
+	c := binary.BigEndian.Uint32(counter) + 1
+	if c == 0 {
+		return errors.New("paste is too large to encrypt")
+	}
+	binary.BigEndian.PutUint32(counter, c)
+	return nil
+}
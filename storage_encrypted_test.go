@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// seal returns the contents encrypted for the paste.
+func seal(t *testing.T, key []byte, id string, plain []byte) []byte {
+	t.Helper()
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := newSealReader(bytes.NewReader(plain), aead, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// open returns the contents decrypted for the paste, failing if
+// opening the reader or reading from it fails.
+func open(key []byte, id string, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	or, err := newOpenReader(ioutil.NopCloser(bytes.NewReader(sealed)), aead, id)
+	if err != nil {
+		return nil, err
+	}
+	defer or.Close()
+	return ioutil.ReadAll(or)
+}
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// sealedSize is the size of the contents once they are sealed,
+// the header and every chunk with its tag.
+func sealedSize(n int) int {
+	chunks := n/encryptionChunkSize + 1
+	if n > 0 && n%encryptionChunkSize == 0 {
+		chunks--
+	}
+	return 1 + noncePrefixSize + n + chunks*16
+}
+
+func TestSealOpen(t *testing.T) {
+	key := newTestKey(t)
+	for _, n := range []int{
+		0,
+		1,
+		encryptionChunkSize - 1,
+		encryptionChunkSize,
+		encryptionChunkSize + 1,
+		2 * encryptionChunkSize,
+		2*encryptionChunkSize + 1,
+	} {
+		plain := make([]byte, n)
+		if _, err := rand.Read(plain); err != nil {
+			t.Fatal(err)
+		}
+
+		sealed := seal(t, key, "paste", plain)
+		if len(sealed) != sealedSize(n) {
+			t.Errorf("%d bytes are %d bytes sealed, expected %d", n, len(sealed), sealedSize(n))
+		}
+		got, err := open(key, "paste", sealed)
+		if err != nil {
+			t.Fatalf("opening %d bytes failed: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("opening %d bytes returned %d different bytes", n, len(got))
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	key := newTestKey(t)
+	plain := bytes.Repeat([]byte("x"), 2*encryptionChunkSize+100)
+	sealed := seal(t, key, "paste", plain)
+	header := 1 + noncePrefixSize
+	chunk := encryptionChunkSize + 16
+
+	flipped := append([]byte{}, sealed...)
+	flipped[header+chunk+10] ^= 1
+
+	// the chunks swapped, of the same size so only the nonces differ
+	full := seal(t, key, "paste", bytes.Repeat([]byte("x"), 3*encryptionChunkSize))
+	swapped := append([]byte{}, full[:header]...)
+	swapped = append(swapped, full[header+chunk:header+2*chunk]...)
+	swapped = append(swapped, full[header:header+chunk]...)
+	swapped = append(swapped, full[header+2*chunk:]...)
+
+	for _, tc := range []struct {
+		name   string
+		id     string
+		key    []byte
+		sealed []byte
+	}{
+		{"empty", "paste", key, nil},
+		{"header only", "paste", key, sealed[:header]},
+		{"truncated at the first chunk boundary", "paste", key, sealed[:header+chunk]},
+		{"truncated at the second chunk boundary", "paste", key, sealed[:header+2*chunk]},
+		{"truncated in the last chunk", "paste", key, sealed[:len(sealed)-1]},
+		{"flipped byte", "paste", key, flipped},
+		{"swapped chunks", "paste", key, swapped},
+		{"unknown version", "paste", key, append([]byte{encryptionVersion + 1}, sealed[1:]...)},
+		{"other paste", "other", key, sealed},
+		{"wrong key", "paste", newTestKey(t), sealed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := open(tc.key, tc.id, tc.sealed)
+			if err == nil {
+				t.Fatalf("opening returned %d bytes instead of failing", len(got))
+			}
+		})
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	fs, err := newFilesystemStore(t.TempDir(), layoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newGCM(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &encryptedStore{Store: fs, keys: map[string]cipher.AEAD{"k1": aead}, primary: "k1"}
+
+	if err := s.Put("paste", strings.NewReader("secret"), &Metadata{ID: "paste"}); err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := fs.Get("paste")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Fatal("the paste is stored in plaintext")
+	}
+	if got := readPaste(t, s, "paste"); got != "secret" {
+		t.Fatalf("paste is %q, expected secret", got)
+	}
+
+	// without the key it fails rather than returning the ciphertext
+	s.keys = map[string]cipher.AEAD{}
+	if _, _, err := s.Get("paste"); err == nil {
+		t.Fatal("getting a paste without its key did not fail")
+	}
+}
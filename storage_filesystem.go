@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// metaDir is the directory inside the storage directory that holds
+	// the metadata of the pastes.
+	metaDir = ".meta"
+
+	// layoutFlat keeps all the pastes in the storage directory.
+	layoutFlat = "flat"
+	// layoutSharded keeps the pastes in two levels of subdirectories
+	// named by the first four characters of their ids.
+	layoutSharded = "sharded"
+)
+
+// filesystemStore stores each paste as a file named by its id in a
+// directory, with the metadata as json files in a hidden subdirectory.
+//
+// In the sharded layout paste abcd1234 is stored as ab/cd/abcd1234, and
+// its metadata as .meta/ab/cd/abcd1234.json. Pastes are looked up in both
+// layouts, so a flat directory keeps working while it is being sharded.
+type filesystemStore struct {
+	dir     string
+	sharded bool
+}
+
+// newFilesystemStore creates the storage directory and returns
+// a Store backed by it.
+func newFilesystemStore(dir, layout string) (*filesystemStore, error) {
+	if layout != layoutFlat && layout != layoutSharded {
+		return nil, fmt.Errorf("unknown storage layout %q", layout)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, metaDir), 0755); err != nil {
+		return nil, fmt.Errorf("creating storage directory %q failed: %v", dir, err)
+	}
+	return &filesystemStore{dir: dir, sharded: layout == layoutSharded}, nil
+}
+
+// shard returns the subdirectories of the paste in the sharded layout.
+// Short ids are padded with underscores.
+func shard(id string) string {
+	if len(id) < 4 {
+		id += strings.Repeat("_", 4-len(id))
+	}
+	return filepath.Join(id[:2], id[2:4])
+}
+
+// paths returns the path of the paste and of its metadata,
+// in the sharded layout or in the flat one.
+func (s *filesystemStore) paths(id string, sharded bool) (string, string) {
+	if sharded {
+		return filepath.Join(s.dir, shard(id), id), filepath.Join(s.dir, metaDir, shard(id), id+".json")
+	}
+	return filepath.Join(s.dir, id), filepath.Join(s.dir, metaDir, id+".json")
+}
+
+func (s *filesystemStore) path(id string) (string, error) {
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", errPasteNotFound
+	}
+	file, _ := s.paths(id, s.sharded)
+	return file, nil
+}
+
+// find returns the paths of the existing paste and its metadata, looking
+// in the layout of the store first and then in the other one.
+func (s *filesystemStore) find(id string) (string, string, error) {
+	if _, err := s.path(id); err != nil {
+		return "", "", err
+	}
+
+	file, metaFile := s.paths(id, s.sharded)
+	otherFile, otherMeta := s.paths(id, !s.sharded)
+	if !isRegular(file) {
+		file = otherFile
+	}
+	if !isRegular(metaFile) {
+		metaFile = otherMeta
+	}
+	return file, metaFile, nil
+}
+
+// isRegular returns whether there is a regular file at path. The flat
+// path of a paste with a two character id is also the path of a shard
+// directory, which is not a paste.
+func isRegular(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func (s *filesystemStore) Put(id string, r io.Reader, meta *Metadata) error {
+	file, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(id); err != errPasteNotFound {
+		if err == nil {
+			return errIDTaken
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// read the contents first so the metadata is complete
+	tmp, err := writeTemp(file, r, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// creating the metadata claims the id, the paste is only
+	// found once its file is linked next to it.
+	metaFile, err := s.createMeta(meta)
+	if os.IsExist(err) {
+		return errIDTaken
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Link(tmp, file); err != nil {
+		os.Remove(metaFile)
+		if os.IsExist(err) {
+			return errIDTaken
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
+
+func (s *filesystemStore) Replace(id string, r io.Reader, meta *Metadata) error {
+	file, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(file, r, 0644); err != nil {
+		return err
+	}
+
+	// drop the copy in the other layout the paste replaces
+	otherFile, _ := s.paths(id, !s.sharded)
+	if err := os.Remove(otherFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.writeMeta(meta)
+}
+
+// createMeta writes the metadata of a new paste, failing with an error
+// satisfying os.IsExist if it exists, and returns its path.
+func (s *filesystemStore) createMeta(meta *Metadata) (string, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	_, metaFile := s.paths(meta.ID, s.sharded)
+	if err := os.MkdirAll(filepath.Dir(metaFile), 0755); err != nil {
+		return "", err
+	}
+	return metaFile, createFileAtomic(metaFile, bytes.NewReader(b), 0644)
+}
+
+func (s *filesystemStore) writeMeta(meta *Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	_, metaFile := s.paths(meta.ID, s.sharded)
+	if err := os.MkdirAll(filepath.Dir(metaFile), 0755); err != nil {
+		return err
+	}
+	if err := writeBytesAtomic(metaFile, b, 0644); err != nil {
+		return err
+	}
+
+	_, otherMeta := s.paths(meta.ID, !s.sharded)
+	if err := os.Remove(otherMeta); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *filesystemStore) Get(id string) (io.ReadCloser, *Metadata, error) {
+	meta, err := s.Stat(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, _, _ := s.find(id)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil, errPasteNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, meta, nil
+}
+
+func (s *filesystemStore) Stat(id string) (*Metadata, error) {
+	file, metaFile, err := s.find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return nil, errPasteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(metaFile)
+	if os.IsNotExist(err) {
+		// Pastes from before metadata was stored only have the file.
+		return &Metadata{
+			ID:      id,
+			Size:    fi.Size(),
+			Created: fi.ModTime(),
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("parsing metadata for %s failed: %v", id, err)
+	}
+	return &meta, nil
+}
+
+func (s *filesystemStore) SetMetadata(meta *Metadata) error {
+	if _, err := s.Stat(meta.ID); err != nil {
+		return err
+	}
+	return s.writeMeta(meta)
+}
+
+func (s *filesystemStore) List() ([]*Metadata, error) {
+	pastes := []*Metadata{}
+	err := s.walk(func(id string) error {
+		meta, err := s.Stat(id)
+		if err != nil {
+			return err
+		}
+		pastes = append(pastes, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(pastes, func(i, j int) bool { return pastes[i].ID < pastes[j].ID })
+	return pastes, nil
+}
+
+// walk calls fn with the id of every paste in either layout.
+func (s *filesystemStore) walk(fn func(id string) error) error {
+	return filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("reading %s failed: %v", path, err)
+		}
+		if path == s.dir {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			// only the two levels of shards have pastes
+			if rel, _ := filepath.Rel(s.dir, path); strings.Count(rel, string(filepath.Separator)) > 1 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(fi.Name())
+	})
+}
+
+func (s *filesystemStore) Delete(id string) error {
+	file, metaFile, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if !isRegular(file) {
+		return errPasteNotFound
+	}
+
+	if err := os.Remove(file); err != nil {
+		if os.IsNotExist(err) {
+			return errPasteNotFound
+		}
+		return err
+	}
+	if err := os.Remove(metaFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// reshard moves the pastes and metadata in the other layout to the layout
+// of the store, returning the number of pastes moved. It is safe to run
+// while the server is running, and to run again if it was interrupted.
+func (s *filesystemStore) reshard() (int, error) {
+	ids := []string{}
+	if err := s.walk(func(id string) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		file, metaFile := s.paths(id, s.sharded)
+		otherFile, otherMeta := s.paths(id, !s.sharded)
+
+		moved := false
+		for _, p := range [][2]string{{otherMeta, metaFile}, {otherFile, file}} {
+			if !isRegular(p[0]) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(p[1]), 0755); err != nil {
+				return n, err
+			}
+			if err := os.Rename(p[0], p[1]); err != nil {
+				return n, fmt.Errorf("moving paste %s failed: %v", id, err)
+			}
+			moved = true
+		}
+		if moved {
+			n++
+		}
+	}
+	return n, nil
+}
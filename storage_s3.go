@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// emptySHA256 is the hex encoded sha256 of an empty payload.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// s3StaleDeleteMarker is how old the marker of a delete has to be
+	// to be taken as left by a delete that never finished.
+	s3StaleDeleteMarker = 10 * time.Minute
+)
+
+// s3Store stores the pastes as objects in a bucket of an S3 compatible
+// object storage, with the metadata as json objects next to them.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+
+	// metaCache holds the metadata List read, by the etag of their
+	// objects, so listing again only reads the metadata that changed.
+	metaMu    sync.Mutex
+	metaCache map[string]cachedMeta
+}
+
+// cachedMeta is the metadata of a paste and the etag of its object.
+type cachedMeta struct {
+	etag string
+	meta Metadata
+}
+
+// newS3Store returns a Store backed by the bucket. The credentials are
+// read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+func newS3Store(endpoint, region, bucket, prefix string, pathStyle bool) (*s3Store, error) {
+	if len(bucket) < 1 {
+		return nil, errors.New("s3 bucket cannot be empty")
+	}
+	if len(endpoint) < 1 {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing s3 endpoint %q failed: %v", endpoint, err)
+	}
+
+	s := &s3Store{
+		endpoint:     u,
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       region,
+		pathStyle:    pathStyle,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if len(s.accessKey) < 1 || len(s.secretKey) < 1 {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for the s3 storage driver")
+	}
+	return s, nil
+}
+
+func (s *s3Store) pasteKey(id string) string {
+	return s.prefix + "pastes/" + id
+}
+
+func (s *s3Store) metaKey(id string) string {
+	return s.prefix + "meta/" + id + ".json"
+}
+
+func (s *s3Store) Put(id string, r io.Reader, meta *Metadata) error {
+	return s.put(id, r, meta, true)
+}
+
+func (s *s3Store) Replace(id string, r io.Reader, meta *Metadata) error {
+	return s.put(id, r, meta, false)
+}
+
+// put stores the paste, failing with errIDTaken if it exists and
+// exclusive is true. The contents are created first, only if there is no
+// object with their key, and the paste is only found once the metadata
+// is stored next to them.
+func (s *s3Store) put(id string, r io.Reader, meta *Metadata, exclusive bool) error {
+	// S3 needs the length of the object up front, so spool the
+	// contents to a temporary file, hashing them on the way.
+	tmp, err := ioutil.TempFile("", "pastebinit-s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := s.putObject(s.pasteKey(id), tmp, n, hex.EncodeToString(h.Sum(nil)), exclusive); err != nil {
+		return err
+	}
+	return s.putMeta(meta)
+}
+
+func (s *s3Store) putMeta(meta *Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(b)
+	return s.putObject(s.metaKey(meta.ID), bytes.NewReader(b), int64(len(b)), hex.EncodeToString(h[:]), false)
+}
+
+// putObject stores the object. If exclusive is true it is only created
+// if there is no object with the key, failing with errIDTaken otherwise.
+func (s *s3Store) putObject(key string, body io.Reader, size int64, payloadHash string, exclusive bool) error {
+	req, err := s.newRequest("PUT", key, nil, body, payloadHash)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if exclusive {
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(id string) (io.ReadCloser, *Metadata, error) {
+	meta, err := s.Stat(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := s.newRequest("GET", s.pasteKey(id), nil, nil, emptySHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, meta, nil
+}
+
+func (s *s3Store) Stat(id string) (*Metadata, error) {
+	req, err := s.newRequest("GET", s.metaKey(id), nil, nil, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var meta Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("parsing metadata for %s failed: %v", id, err)
+	}
+	return &meta, nil
+}
+
+func (s *s3Store) SetMetadata(meta *Metadata) error {
+	if _, err := s.Stat(meta.ID); err != nil {
+		return err
+	}
+	return s.putMeta(meta)
+}
+
+// listBucketResult is the response of the ListObjectsV2 call.
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		ETag string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Store) List() ([]*Metadata, error) {
+	s.metaMu.Lock()
+	cache := s.metaCache
+	s.metaMu.Unlock()
+
+	pastes := []*Metadata{}
+	listed := map[string]cachedMeta{}
+	prefix := s.prefix + "meta/"
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest("GET", "", query, nil, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing bucket listing failed: %v", err)
+		}
+
+		for _, obj := range result.Contents {
+			id := strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".json")
+			if c, ok := cache[id]; ok && c.etag == obj.ETag {
+				meta := c.meta
+				pastes = append(pastes, &meta)
+				listed[id] = c
+				continue
+			}
+
+			meta, err := s.Stat(id)
+			if err == errPasteNotFound {
+				// Deleted since we listed the bucket.
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			pastes = append(pastes, meta)
+			listed[id] = cachedMeta{etag: obj.ETag, meta: *meta}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	// keep only what is still there for the next listing
+	s.metaMu.Lock()
+	s.metaCache = listed
+	s.metaMu.Unlock()
+
+	sort.Slice(pastes, func(i, j int) bool { return pastes[i].ID < pastes[j].ID })
+	return pastes, nil
+}
+
+func (s *s3Store) deletingKey(id string) string {
+	return s.prefix + "deleting/" + id
+}
+
+func (s *s3Store) Delete(id string) error {
+	if err := s.claimDelete(id); err != nil {
+		return err
+	}
+	if err := s.deletePaste(id); err != nil {
+		// drop the claim, so the next delete tries again rather than
+		// taking the paste for deleted
+		if err := s.deleteObject(s.deletingKey(id)); err != nil {
+			logrus.Warnf("deleting the delete marker of paste %s failed: %v", id, err)
+		}
+		return err
+	}
+
+	// the marker is deleted last, so a delete that claims it
+	// afterwards finds the paste is gone.
+	return s.deleteObject(s.deletingKey(id))
+}
+
+// claimDelete claims the delete of the paste. S3 does not tell us if the
+// objects existed, so the delete is claimed by creating a marker only one
+// delete can create, holding the time it was claimed, and the paste is
+// checked for after that. A marker older than s3StaleDeleteMarker is left
+// by a delete that stopped halfway and is claimed again.
+func (s *s3Store) claimDelete(id string) error {
+	err := s.putDeleteMarker(id)
+	if err != errIDTaken {
+		return err
+	}
+
+	req, err := s.newRequest("GET", s.deletingKey(id), nil, nil, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		// errPasteNotFound if the other delete has just finished
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	// markers that do not parse are taken as stale
+	claimed, _ := time.Parse(time.RFC3339, string(b))
+	if time.Since(claimed) < s3StaleDeleteMarker {
+		// another delete is in progress
+		return errPasteNotFound
+	}
+
+	logrus.Warnf("claiming the delete of paste %s again, it was left unfinished at %s", id, b)
+	if err := s.deleteObject(s.deletingKey(id)); err != nil {
+		return err
+	}
+	if err := s.putDeleteMarker(id); err != nil {
+		if err == errIDTaken {
+			return errPasteNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// putDeleteMarker creates the delete marker of the paste, failing with
+// errIDTaken if there is one.
+func (s *s3Store) putDeleteMarker(id string) error {
+	b := []byte(time.Now().UTC().Format(time.RFC3339))
+	sum := sha256.Sum256(b)
+	return s.putObject(s.deletingKey(id), bytes.NewReader(b), int64(len(b)), hex.EncodeToString(sum[:]), true)
+}
+
+// deletePaste deletes the objects of the paste once its delete is
+// claimed, failing with errPasteNotFound if it does not exist.
+func (s *s3Store) deletePaste(id string) error {
+	if _, err := s.Stat(id); err != nil {
+		return err
+	}
+	for _, key := range []string{s.pasteKey(id), s.metaKey(id)} {
+		if err := s.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) deleteObject(key string) error {
+	req, err := s.newRequest("DELETE", key, nil, nil, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Error is the error response of the S3 API.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends the request and turns error responses into errors.
+func (s *s3Store) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 request %s %s failed: %v", req.Method, req.URL.Path, err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errPasteNotFound
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		// an If-None-Match put of an object that exists
+		return nil, errIDTaken
+	}
+	var e s3Error
+	if err := xml.NewDecoder(resp.Body).Decode(&e); err != nil || len(e.Code) < 1 {
+		return nil, fmt.Errorf("s3 request %s %s failed: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	if e.Code == "ConditionalRequestConflict" {
+		// another If-None-Match put of the object is in progress
+		return nil, errIDTaken
+	}
+	return nil, fmt.Errorf("s3 request %s %s failed: %s: %s", req.Method, req.URL.Path, e.Code, e.Message)
+}
+
+// newRequest creates a signed request for the object key in the bucket.
+func (s *s3Store) newRequest(method, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the AWS signature version 4 authorization to the request.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if len(s.sessionToken) > 0 {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	// Sign the host and all the x-amz headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	for _, v := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query returns the query string encoded the way AWS signatures expect,
+// sorted by key and with spaces as %20.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape uri encodes s the way AWS signatures expect. Slashes are
+// only encoded if encodeSlash is true.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeS3AccessKey = "AKIDEXAMPLE"
+	fakeS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	fakeS3Region    = "us-test-1"
+	fakeS3Bucket    = "pastes"
+	// fakeS3PageSize is the number of keys in each page of the listings,
+	// small so the paging is tested.
+	fakeS3PageSize = 2
+)
+
+// fakeS3 is an in-process S3 server with a single bucket, enough of the
+// API for the s3 driver. It checks the signatures of all the requests,
+// refusing them like S3 does if they are wrong.
+type fakeS3 struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests map[string]int
+	// failing holds the requests, as method and key, that fail
+	// with an internal error.
+	failing map[string]bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, objects: map[string][]byte{}, requests: map[string]int{}, failing: map[string]bool{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// newTestS3Store returns an s3Store using the fake server.
+func newTestS3Store(t *testing.T, srv *httptest.Server, prefix string) *s3Store {
+	t.Setenv("AWS_ACCESS_KEY_ID", fakeS3AccessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", fakeS3SecretKey)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	s, err := newS3Store(srv.URL, fakeS3Region, fakeS3Bucket, prefix, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.t.Errorf("reading request body failed: %v", err)
+		return
+	}
+	if err := f.checkSignature(r, body); err != nil {
+		f.t.Logf("%s %s: %v", r.Method, r.URL, err)
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != fakeS3Bucket && !strings.HasPrefix(path, fakeS3Bucket+"/") {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, fakeS3Bucket), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method+" "+key]++
+	if f.failing[r.Method+" "+key] {
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && len(key) < 1 && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query())
+	case r.Method == "PUT":
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET":
+		b, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", etag(b))
+		w.Write(b)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed")
+	}
+}
+
+// list writes a page of the ListObjectsV2 listing of the keys with the
+// prefix. The continuation tokens are the last key of the previous page
+// with characters that need escaping around it.
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	after := ""
+	if token := query.Get("continuation-token"); len(token) > 0 {
+		after = strings.TrimSuffix(strings.TrimPrefix(token, "a+/= "), " =/+z")
+	}
+
+	keys := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type object struct {
+		Key  string
+		ETag string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > fakeS3PageSize {
+		keys = keys[:fakeS3PageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = "a+/= " + keys[len(keys)-1] + " =/+z"
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, object{Key: k, ETag: etag(f.objects[k])})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func writeS3Error(w http.ResponseWriter, code int, s3Code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3Code, msg)
+}
+
+// checkSignature checks the AWS signature version 4 of the request,
+// working out the canonical request from what was received.
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return fmt.Errorf("unsigned request, Authorization is %q", auth)
+	}
+	fields := map[string]string{}
+	for _, f := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	date, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("invalid X-Amz-Date %q", amzDate)
+	}
+	scope := date.Format("20060102") + "/" + fakeS3Region + "/s3/aws4_request"
+	if fields["Credential"] != fakeS3AccessKey+"/"+scope {
+		return fmt.Errorf("credential is %q, expected %q", fields["Credential"], fakeS3AccessKey+"/"+scope)
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("x-amz-content-sha256 is %q, but the body hashes to %x", payloadHash, sum)
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !contains(signed, required) {
+			return fmt.Errorf("%s is not signed", required)
+		}
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, false),
+		awsQuery(r.URL.Query()),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+fakeS3SecretKey), date.Format("20060102"))
+	for _, v := range []string{fakeS3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	if expected := hex.EncodeToString(hmacSHA256(key, stringToSign)); fields["Signature"] != expected {
+		return fmt.Errorf("signature is %s, expected %s for the canonical request:\n%s", fields["Signature"], expected, canonicalRequest)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// awsEscape escapes s the way AWS does with the escaping of the url
+// package, rather than the one of the s3 driver.
+func awsEscape(s string, encodeSlash bool) string {
+	e := strings.NewReplacer("+", "%20", "*", "%2A", "%7E", "~").Replace(url.QueryEscape(s))
+	if !encodeSlash {
+		e = strings.Replace(e, "%2F", "/", -1)
+	}
+	return e
+}
+
+func awsQuery(query url.Values) string {
+	var parts []string
+	for k, vs := range query {
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func TestS3Store(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv, "some prefix/")
+
+	ids := []string{"abc", "ABC-def_1", "zz", "x-y", "q_q"}
+	for i, id := range ids {
+		meta := &Metadata{ID: id, Size: int64(i), Filename: id + ".txt"}
+		if err := s.Put(id, strings.NewReader("paste "+id), meta); err != nil {
+			t.Fatalf("putting %s failed: %v", id, err)
+		}
+	}
+	if err := s.Put("abc", strings.NewReader("again"), &Metadata{ID: "abc"}); err != errIDTaken {
+		t.Fatalf("putting an existing paste returned %v, expected errIDTaken", err)
+	}
+
+	for _, id := range ids {
+		if got := readPaste(t, s, id); got != "paste "+id {
+			t.Fatalf("paste %s is %q, expected %q", id, got, "paste "+id)
+		}
+		meta, err := s.Stat(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Filename != id+".txt" {
+			t.Fatalf("filename of %s is %q, expected %q", id, meta.Filename, id+".txt")
+		}
+	}
+	if _, err := s.Stat("missing"); err != errPasteNotFound {
+		t.Fatalf("stat of a missing paste returned %v, expected errPasteNotFound", err)
+	}
+	if _, _, err := s.Get("missing"); err != errPasteNotFound {
+		t.Fatalf("get of a missing paste returned %v, expected errPasteNotFound", err)
+	}
+
+	// the listing is split over pages by the fake
+	pastes, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if len(pastes) != len(ids) {
+		t.Fatalf("listed %d pastes, expected %d", len(pastes), len(ids))
+	}
+	for i, p := range pastes {
+		if p.ID != ids[i] {
+			t.Fatalf("paste %d listed is %s, expected %s", i, p.ID, ids[i])
+		}
+	}
+
+	if err := s.Replace("abc", strings.NewReader("replaced"), &Metadata{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPaste(t, s, "abc"); got != "replaced" {
+		t.Fatalf("paste is %q after replacing it, expected replaced", got)
+	}
+
+	if err := s.Delete("zz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("zz"); err != errPasteNotFound {
+		t.Fatalf("deleting a deleted paste returned %v, expected errPasteNotFound", err)
+	}
+	if _, err := s.Stat("zz"); err != errPasteNotFound {
+		t.Fatalf("stat of a deleted paste returned %v, expected errPasteNotFound", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.objects {
+		if strings.Contains(key, "zz") {
+			t.Fatalf("object %s of the deleted paste is left", key)
+		}
+	}
+}
+
+func TestS3StoreListCache(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv, "")
+
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.Put(id, strings.NewReader(id), &Metadata{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metaGets := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		n := 0
+		for req, count := range f.requests {
+			if strings.HasPrefix(req, "GET meta/") {
+				n += count
+			}
+		}
+		return n
+	}
+
+	if _, err := s.List(); err != nil {
+		t.Fatal(err)
+	}
+	before := metaGets()
+	if _, err := s.List(); err != nil {
+		t.Fatal(err)
+	}
+	if n := metaGets() - before; n != 0 {
+		t.Fatalf("listing again read the metadata %d times, expected none", n)
+	}
+
+	// only the metadata that changed is read again
+	if err := s.SetMetadata(&Metadata{ID: "c", Visibility: visibilityPrivate}); err != nil {
+		t.Fatal(err)
+	}
+	before = metaGets()
+	pastes, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := metaGets() - before; n != 1 {
+		t.Fatalf("listing after changing one paste read the metadata %d times, expected 1", n)
+	}
+	for _, p := range pastes {
+		if p.ID == "c" && p.Visibility != visibilityPrivate {
+			t.Fatalf("listed the old metadata of a changed paste: %+v", p)
+		}
+	}
+}
+
+func TestS3StoreDeleteMarker(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv, "")
+	if err := s.Put("abc", strings.NewReader("paste"), &Metadata{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	setMarker := func(b string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.objects[s.deletingKey("abc")] = []byte(b)
+	}
+	setFailing := func(req string, failing bool) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.failing[req] = failing
+	}
+
+	// a delete in progress
+	setMarker(time.Now().UTC().Format(time.RFC3339))
+	if err := s.Delete("abc"); err != errPasteNotFound {
+		t.Fatalf("deleting a paste being deleted returned %v, expected errPasteNotFound", err)
+	}
+
+	// a failed delete drops its marker, so the next one deletes the paste
+	f.mu.Lock()
+	delete(f.objects, s.deletingKey("abc"))
+	f.mu.Unlock()
+	setFailing("DELETE "+s.pasteKey("abc"), true)
+	if err := s.Delete("abc"); err == nil || err == errPasteNotFound {
+		t.Fatalf("deleting a paste whose object fails to delete returned %v, expected the error", err)
+	}
+	setFailing("DELETE "+s.pasteKey("abc"), false)
+	if err := s.Delete("abc"); err != nil {
+		t.Fatalf("deleting a paste after a failed delete returned %v", err)
+	}
+
+	// a delete that stopped halfway, by a server that died
+	if err := s.Put("abc", strings.NewReader("paste"), &Metadata{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range []string{time.Now().Add(-s3StaleDeleteMarker - time.Minute).UTC().Format(time.RFC3339), ""} {
+		setMarker(marker)
+		if err := s.Delete("abc"); err != nil {
+			t.Fatalf("deleting a paste with a stale marker %q returned %v", marker, err)
+		}
+		if _, err := s.Stat("abc"); err != errPasteNotFound {
+			t.Fatalf("stat of a deleted paste returned %v, expected errPasteNotFound", err)
+		}
+		if err := s.Put("abc", strings.NewReader("paste"), &Metadata{ID: "abc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.objects[s.deletingKey("abc")]; ok {
+		t.Fatal("the delete marker is left")
+	}
+}
+
+func TestS3StoreBadSignature(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv, "")
+	s.secretKey = "wrong"
+
+	err := s.Put("abc", strings.NewReader("paste"), &Metadata{ID: "abc"})
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("put with the wrong secret returned %v, expected SignatureDoesNotMatch", err)
+	}
+	if len(f.objects) != 0 {
+		t.Fatalf("put with the wrong secret stored %d objects", len(f.objects))
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	for _, s := range []string{"", "abc", "a b", "a+b", "a/b", "a~b", "a*b", "ä", "a=b&c", "%2F"} {
+		for _, slash := range []bool{false, true} {
+			if got, expected := s3Escape(s, slash), awsEscape(s, slash); got != expected {
+				t.Errorf("s3Escape(%q, %v) = %q, expected %q", s, slash, got, expected)
+			}
+		}
+	}
+	if got, expected := strconv.Quote(s3Query(url.Values{"b": {"1 2"}, "a": {"x/y"}})), strconv.Quote("a=x%2Fy&b=1%202"); got != expected {
+		t.Errorf("s3Query = %s, expected %s", got, expected)
+	}
+}
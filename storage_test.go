@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testDrivers returns a new store of each storage driver, with the s3
+// driver using a fake server.
+func testDrivers(t *testing.T) map[string]Store {
+	dir := t.TempDir()
+
+	flat, err := newFilesystemStore(filepath.Join(dir, "flat"), layoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded, err := newFilesystemStore(filepath.Join(dir, "sharded"), layoutSharded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newDBStore(filepath.Join(dir, "pastes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+
+	_, srv := newFakeS3(t)
+
+	return map[string]Store{
+		"filesystem": flat,
+		"sharded":    sharded,
+		"db":         db,
+		"s3":         newTestS3Store(t, srv, "prefix/"),
+	}
+}
+
+// readPaste returns the contents of the paste in the store.
+func readPaste(t *testing.T, s Store, id string) string {
+	t.Helper()
+	rc, _, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("getting %s failed: %v", id, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %s failed: %v", id, err)
+	}
+	return string(b)
+}
+
+func TestStorePutExclusive(t *testing.T) {
+	for name, s := range testDrivers(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Put("abcd1234", strings.NewReader("first"), &Metadata{ID: "abcd1234"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("abcd1234", strings.NewReader("second"), &Metadata{ID: "abcd1234"}); err != errIDTaken {
+				t.Fatalf("putting an existing paste returned %v, expected errIDTaken", err)
+			}
+			if got := readPaste(t, s, "abcd1234"); got != "first" {
+				t.Fatalf("paste is %q after a failed put, expected first", got)
+			}
+
+			if err := s.Replace("abcd1234", strings.NewReader("third"), &Metadata{ID: "abcd1234"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readPaste(t, s, "abcd1234"); got != "third" {
+				t.Fatalf("paste is %q after replacing it, expected third", got)
+			}
+		})
+	}
+}
+
+func TestStorePutConcurrent(t *testing.T) {
+	for name, s := range testDrivers(t) {
+		t.Run(name, func(t *testing.T) {
+			const n = 16
+			var (
+				wg   sync.WaitGroup
+				errs = make([]error, n)
+			)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = s.Put("slug", strings.NewReader("paste"), &Metadata{ID: "slug"})
+				}(i)
+			}
+			wg.Wait()
+
+			stored := 0
+			for _, err := range errs {
+				switch err {
+				case nil:
+					stored++
+				case errIDTaken:
+				default:
+					t.Fatal(err)
+				}
+			}
+			if stored != 1 {
+				t.Fatalf("%d concurrent puts of the same id succeeded, expected 1", stored)
+			}
+		})
+	}
+}
+
+func TestStoreDeleteConcurrent(t *testing.T) {
+	stores := testDrivers(t)
+	for name, s := range testDrivers(t) {
+		wrapped, err := (&storeConfig{compression: compressionNone, dedup: true}).wrap(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[name+"-wrapped"] = wrapped
+	}
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Put("burn", strings.NewReader("secret"), &Metadata{ID: "burn", Burn: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			const n = 16
+			var (
+				wg   sync.WaitGroup
+				errs = make([]error, n)
+			)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = s.Delete("burn")
+				}(i)
+			}
+			wg.Wait()
+
+			deleted := 0
+			for _, err := range errs {
+				switch err {
+				case nil:
+					deleted++
+				case errPasteNotFound:
+				default:
+					t.Fatal(err)
+				}
+			}
+			if deleted != 1 {
+				t.Fatalf("%d concurrent deletes of the same paste succeeded, expected 1", deleted)
+			}
+		})
+	}
+}
+
+func TestFilesystemStoreShardIDs(t *testing.T) {
+	s := testDrivers(t)["sharded"].(*filesystemStore)
+	if err := s.Put("abcd1234", strings.NewReader("paste"), &Metadata{ID: "abcd1234"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// ab is the shard directory of the paste, not a paste
+	if _, err := s.Stat("ab"); err != errPasteNotFound {
+		t.Fatalf("stat of a shard directory returned %v, expected errPasteNotFound", err)
+	}
+	if _, _, err := s.Get("ab"); err != errPasteNotFound {
+		t.Fatalf("get of a shard directory returned %v, expected errPasteNotFound", err)
+	}
+	if err := s.Delete("ab"); err != errPasteNotFound {
+		t.Fatalf("deleting a shard directory returned %v, expected errPasteNotFound", err)
+	}
+
+	// and its name can be used as a slug
+	if err := s.Put("ab", strings.NewReader("slug"), &Metadata{ID: "ab"}); err != nil {
+		t.Fatalf("putting a paste named like a shard directory failed: %v", err)
+	}
+	if got := readPaste(t, s, "ab"); got != "slug" {
+		t.Fatalf("paste is %q, expected slug", got)
+	}
+	if got := readPaste(t, s, "abcd1234"); got != "paste" {
+		t.Fatalf("paste is %q, expected paste", got)
+	}
+	if n, err := s.reshard(); err != nil || n != 0 {
+		t.Fatalf("resharding a sharded store moved %d pastes and returned %v, expected none", n, err)
+	}
+	pastes, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pastes) != 2 || pastes[0].ID != "ab" || pastes[1].ID != "abcd1234" {
+		t.Fatalf("listed %d pastes, expected ab and abcd1234", len(pastes))
+	}
+	if err := s.Delete("ab"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPaste(t, s, "abcd1234"); got != "paste" {
+		t.Fatalf("paste is %q after deleting ab, expected paste", got)
+	}
+}
+
+func TestStoreGetEncoded(t *testing.T) {
+	content := strings.Repeat("hello compressed world\n", 100)
+	for _, compression := range []string{compressionNone, compressionGzip, compressionZstd} {
+		for name, driver := range testDrivers(t) {
+			t.Run(compression+"/"+name, func(t *testing.T) {
+				s, err := (&storeConfig{compression: compression}).wrap(driver)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Put("paste", strings.NewReader(content), &Metadata{ID: "paste"}); err != nil {
+					t.Fatal(err)
+				}
+				if got := readPaste(t, s, "paste"); got != content {
+					t.Fatalf("paste is %q, expected the contents put", got)
+				}
+
+				for _, encoding := range []string{compressionGzip, compressionZstd} {
+					rc, meta, encoded, err := s.(encodedStore).GetEncoded("paste", encoding)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if encoded != (encoding == compression) {
+						t.Fatalf("getting the paste stored with %s as %s returned encoded %v", compression, encoding, encoded)
+					}
+					if encoded {
+						if rc, err = decompressReader(rc, encoding); err != nil {
+							t.Fatal(err)
+						}
+					}
+					b, err := ioutil.ReadAll(rc)
+					rc.Close()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(b) != content {
+						t.Fatalf("paste got as %s is %q, expected the contents put", encoding, b)
+					}
+					if meta.ID != "paste" {
+						t.Fatalf("metadata is %+v, expected the paste's", meta)
+					}
+				}
+			})
+		}
+	}
+}
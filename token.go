@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const tokenHelp = `Create, list or revoke api tokens.`
+
+func (cmd *tokenCommand) Name() string      { return "token" }
+func (cmd *tokenCommand) Args() string      { return "create|list|revoke [ID]" }
+func (cmd *tokenCommand) ShortHelp() string { return tokenHelp }
+func (cmd *tokenCommand) LongHelp() string  { return tokenHelp }
+func (cmd *tokenCommand) Hidden() bool      { return false }
+
+func (cmd *tokenCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.name, "name", "", "name of the token to create")
+	fs.StringVar(&cmd.scopes, "scopes", scopeUpload, "comma separated scopes of the token to create (upload, read-private, admin)")
+}
+
+type tokenCommand struct {
+	name   string
+	scopes string
+}
+
+func (cmd *tokenCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("pass one of create, list or revoke")
+	}
+	if err := checkCredentials(); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		var resp map[string]string
+		if err := apiRequest("POST", "api/tokens", tokenRequest{
+			Name:   cmd.name,
+			Scopes: strings.Split(cmd.scopes, ","),
+		}, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("Your token %s has been created, it will not be shown again:\n%s\n", resp["id"], resp["token"])
+	case "list":
+		var tokens []apiToken
+		if err := apiRequest("GET", "api/tokens", nil, &tokens); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tOWNER\tSCOPES\tCREATED")
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Owner, strings.Join(t.Scopes, ","), t.Created.Format("2006-01-02T15:04:05Z07:00"))
+		}
+		w.Flush()
+	case "revoke":
+		if len(args) < 2 {
+			return errors.New("pass the id of the token to revoke")
+		}
+		if err := apiRequest("DELETE", "api/tokens/"+args[1], nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Your token %s has been revoked\n", args[1])
+	default:
+		return fmt.Errorf("%s: no such token command", args[0])
+	}
+	return nil
+}
+
+// apiRequest sends the json encoded body to the api endpoint of the
+// server and decodes the json response into v.
+func apiRequest(method, endpoint string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, baseuri+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuth(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s%s failed: %v", baseuri, endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return fmt.Errorf("unauthorized - please check your credentials: %d", resp.StatusCode)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response body failed: %v", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var respErr map[string]string
+		if err := json.Unmarshal(respBody, &respErr); err == nil && len(respErr["error"]) > 0 {
+			return fmt.Errorf("server responded with %s", respErr["error"])
+		}
+		return fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, v); err != nil {
+		return fmt.Errorf("parsing body as json failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// scopeUpload lets a token upload pastes.
+	scopeUpload = "upload"
+	// scopeReadPrivate lets a token read the owner's pastes and index.
+	scopeReadPrivate = "read-private"
+	// scopeAdmin lets a token do anything the owner can, including
+	// managing tokens.
+	scopeAdmin = "admin"
+)
+
+// validScope returns whether s is a known token scope.
+func validScope(s string) bool {
+	return s == scopeUpload || s == scopeReadPrivate || s == scopeAdmin
+}
+
+// apiToken is a bearer token minted by the server. Only the sha256
+// hash of the secret part of the token is kept.
+type apiToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Owner   string    `json:"owner"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// hasScope returns whether the token was given the scope.
+// Admin tokens have every scope.
+func (t *apiToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenStore keeps the api tokens in a json file.
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*apiToken
+	// newID generates the ids of new tokens.
+	newID func() (string, error)
+}
+
+// loadTokens reads the tokens from the json file at path,
+// which does not need to exist yet.
+func loadTokens(path string) (*tokenStore, error) {
+	s := &tokenStore{
+		path:   path,
+		tokens: map[string]*apiToken{},
+		newID:  uuid,
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading tokens file %q failed: %v", path, err)
+	}
+
+	var tokens []*apiToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("parsing tokens file %q failed: %v", path, err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.ID] = t
+	}
+	return s, nil
+}
+
+// save writes the tokens to the file. The caller must hold s.mu.
+func (s *tokenStore) save() error {
+	tokens := make([]*apiToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	if err := writeBytesAtomic(s.path, b, 0600); err != nil {
+		return fmt.Errorf("writing tokens file %q failed: %v", s.path, err)
+	}
+	return nil
+}
+
+// create mints a new token for the owner and returns it along with
+// the secret token string, which is never shown again.
+func (s *tokenStore) create(owner, name string, scopes []string) (*apiToken, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// never overwrite an existing token with a colliding id
+	var id string
+	for i := 0; ; i++ {
+		if i == idAttempts {
+			return nil, "", fmt.Errorf("no free token id found after %d attempts", idAttempts)
+		}
+		var err error
+		if id, err = s.newID(); err != nil {
+			return nil, "", err
+		}
+		if _, ok := s.tokens[id]; !ok {
+			break
+		}
+	}
+
+	t := &apiToken{
+		ID:      id,
+		Name:    name,
+		Owner:   owner,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Hash:    hex.EncodeToString(hash[:]),
+	}
+	s.tokens[id] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return nil, "", err
+	}
+	return t, id + "." + hex.EncodeToString(secret), nil
+}
+
+// lookup returns the token for the secret token string.
+func (s *tokenStore) lookup(token string) (*apiToken, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	secret, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	t, ok := s.tokens[parts[0]]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(t.Hash)) != 1 {
+		return nil, false
+	}
+	return t, true
+}
+
+// list returns the tokens of the owner, or every token if owner is empty.
+// The hashes are not included.
+func (s *tokenStore) list(owner string) []*apiToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []*apiToken{}
+	for _, t := range s.tokens {
+		if len(owner) > 0 && t.Owner != owner {
+			continue
+		}
+		c := *t
+		c.Hash = ""
+		tokens = append(tokens, &c)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens
+}
+
+// revoke deletes the token. Unless owner is empty the token
+// has to belong to the owner.
+func (s *tokenStore) revoke(id, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || (len(owner) > 0 && t.Owner != owner) {
+		return fmt.Errorf("no such token: %s", id)
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+	return nil
+}
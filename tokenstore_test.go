@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTokenRequest returns a request to the server with the bearer token.
+func newTokenRequest(t *testing.T, method, url, token string, body string) *http.Request {
+	t.Helper()
+	req := newTestRequest(t, method, url, "", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// createTestToken mints a token for the owner with the scopes.
+func createTestToken(t *testing.T, cmd *serverCommand, owner string, scopes ...string) string {
+	t.Helper()
+	_, token, err := cmd.tokens.create(owner, "test", scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenScopes(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	private := postTestPaste(t, srv, "alice", "visibility=private", "private paste")
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		upload int
+		read   int
+		index  int
+		api    int
+	}{
+		{"upload", createTestToken(t, cmd, "alice", scopeUpload), http.StatusOK, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"read-private", createTestToken(t, cmd, "alice", scopeReadPrivate), http.StatusUnauthorized, http.StatusOK, http.StatusOK, http.StatusUnauthorized},
+		{"admin", createTestToken(t, cmd, "alice", scopeAdmin), http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		{"read-private of another user", createTestToken(t, cmd, "bob", scopeReadPrivate), http.StatusUnauthorized, http.StatusNotFound, http.StatusOK, http.StatusUnauthorized},
+		// the admin powers of the owner only come with admin tokens
+		{"read-private of an admin", createTestToken(t, cmd, "admin", scopeReadPrivate), http.StatusUnauthorized, http.StatusNotFound, http.StatusOK, http.StatusUnauthorized},
+		{"wrong secret", strings.SplitN(createTestToken(t, cmd, "alice", scopeAdmin), ".", 2)[0] + ".00", http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, req := range []struct {
+				method string
+				path   string
+				status int
+			}{
+				{"POST", "/paste", tc.upload},
+				{"GET", "/" + private, tc.read},
+				{"GET", "/", tc.index},
+				{"GET", "/api/tokens", tc.api},
+			} {
+				resp, body := doTestRequest(t, newTokenRequest(t, req.method, srv.URL+req.path, tc.token, "paste"))
+				if resp.StatusCode != req.status {
+					t.Fatalf("%s %s returned %s, expected %d: %s", req.method, req.path, resp.Status, req.status, body)
+				}
+				if req.path == "/" && resp.StatusCode == http.StatusOK && strings.Contains(body, private) != (tc.read == http.StatusOK) {
+					t.Fatalf("index lists the private paste: %v, expected %v", strings.Contains(body, private), tc.read == http.StatusOK)
+				}
+			}
+		})
+	}
+}
+
+func TestTokensAPI(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+
+	// only admins can mint admin tokens
+	for user, status := range map[string]int{"alice": http.StatusForbidden, "admin": http.StatusOK} {
+		req := newTestRequest(t, "POST", srv.URL+"/api/tokens", user, strings.NewReader(`{"name":"ci","scopes":["admin"]}`))
+		if resp, body := doTestRequest(t, req); resp.StatusCode != status {
+			t.Fatalf("creating an admin token as %s returned %s, expected %d: %s", user, resp.Status, status, body)
+		}
+	}
+	for _, body := range []string{`{"scopes":[]}`, `{"scopes":["root"]}`, `scopes`} {
+		req := newTestRequest(t, "POST", srv.URL+"/api/tokens", "alice", strings.NewReader(body))
+		if resp, _ := doTestRequest(t, req); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("creating a token with %s returned %s, expected 400", body, resp.Status)
+		}
+	}
+
+	req := newTestRequest(t, "POST", srv.URL+"/api/tokens", "alice", strings.NewReader(`{"name":"ci","scopes":["upload"]}`))
+	resp, body := doTestRequest(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("creating a token returned %s: %s", resp.Status, body)
+	}
+	var created map[string]string
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := doTestRequest(t, newTokenRequest(t, "POST", srv.URL+"/paste", created["token"], "paste")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("uploading with the new token returned %s: %s", resp.Status, body)
+	}
+
+	// other users can neither see nor revoke it
+	_, list := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/api/tokens", "bob", nil))
+	if strings.Contains(list, created["id"]) {
+		t.Fatalf("tokens of bob include the token of alice: %s", list)
+	}
+	if resp, _ := doTestRequest(t, newTestRequest(t, "DELETE", srv.URL+"/api/tokens/"+created["id"], "bob", nil)); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("revoking the token of another user returned %s, expected 404", resp.Status)
+	}
+
+	// and revoked tokens no longer work
+	if resp, body := doTestRequest(t, newTestRequest(t, "DELETE", srv.URL+"/api/tokens/"+created["id"], "alice", nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking the token returned %s: %s", resp.Status, body)
+	}
+	if resp, _ := doTestRequest(t, newTokenRequest(t, "POST", srv.URL+"/paste", created["token"], "paste")); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("uploading with a revoked token returned %s, expected 401", resp.Status)
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := loadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, token, err := s.create("alice", "ci", []string{scopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens survive a restart, without their secret
+	if s, err = loadTokens(path); err != nil {
+		t.Fatal(err)
+	}
+	if tok, ok := s.lookup(token); !ok || tok.ID != created.ID || tok.Owner != "alice" || !tok.hasScope(scopeUpload) || tok.hasScope(scopeReadPrivate) {
+		t.Fatalf("lookup of the token after reloading returned %+v, %v", tok, ok)
+	}
+	if tokens := s.list(""); len(tokens) != 1 || len(tokens[0].Hash) > 0 {
+		t.Fatalf("listed tokens %+v, expected one without its hash", tokens)
+	}
+}
+
+func TestCreateTokenIDTaken(t *testing.T) {
+	s, err := loadTokens(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"taken", "taken", "free"}
+	s.newID = func() (string, error) {
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+	first, firstToken, err := s.create("alice", "first", []string{scopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a colliding id is generated again instead of replacing the token
+	second, _, err := s.create("bob", "second", []string{scopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != "taken" || second.ID != "free" {
+		t.Fatalf("tokens got the ids %s and %s, expected taken and free", first.ID, second.ID)
+	}
+	if tok, ok := s.lookup(firstToken); !ok || tok.Owner != "alice" {
+		t.Fatalf("lookup of the first token returned %+v, %v", tok, ok)
+	}
+
+	s.newID = func() (string, error) { return "taken", nil }
+	if _, _, err := s.create("bob", "third", []string{scopeUpload}); err == nil {
+		t.Fatal("creating a token without a free id did not fail")
+	}
+	if tokens := s.list(""); len(tokens) != 2 {
+		t.Fatalf("%d tokens stored, expected 2", len(tokens))
+	}
+}
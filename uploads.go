@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadOffsetHeader holds the offset a chunk of a resumable upload
+	// starts at in requests, and the offset of the upload in responses.
+	uploadOffsetHeader = "Upload-Offset"
+	// uploadEncodingHeader is the header of the request creating a
+	// resumable upload with the content encoding of the whole upload.
+	uploadEncodingHeader = "Upload-Encoding"
+	// uploadMaxAge is how long unfinished uploads are kept.
+	uploadMaxAge = 24 * time.Hour
+)
+
+// errUploadNotFound is returned when the resumable upload does not exist.
+var errUploadNotFound = errors.New("upload not found")
+
+// upload is a resumable upload. It is created with the options of the
+// paste, the contents are sent in chunks and then it is finished, which
+// stores the paste.
+type upload struct {
+	ID       string    `json:"id"`
+	Owner    string    `json:"owner"`
+	Created  time.Time `json:"created"`
+	Expire   string    `json:"expire,omitempty"`
+	Encoding string    `json:"encoding,omitempty"`
+	Meta     *Metadata `json:"meta"`
+
+	// Response is the response of finishing the upload, kept so the
+	// client can ask again if it did not get it.
+	Response JSONResponse `json:"response,omitempty"`
+}
+
+// uploadStore keeps the resumable uploads in a directory, with the
+// contents received so far in a file named by the id of the upload
+// and its state in a json file next to it.
+type uploadStore struct {
+	dir string
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// newUploadStore creates the uploads directory and returns
+// an uploadStore backed by it.
+func newUploadStore(dir string) (*uploadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating uploads directory %q failed: %v", dir, err)
+	}
+	return &uploadStore{dir: dir, busy: map[string]bool{}}, nil
+}
+
+func (s *uploadStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *uploadStore) statePath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// create starts the upload with no contents.
+func (s *uploadStore) create(up *upload) error {
+	if err := ioutil.WriteFile(s.dataPath(up.ID), nil, 0600); err != nil {
+		return err
+	}
+	return s.save(up)
+}
+
+// save writes the state of the upload.
+func (s *uploadStore) save(up *upload) error {
+	b, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	return writeBytesAtomic(s.statePath(up.ID), b, 0600)
+}
+
+// get returns the upload and the offset of the contents received so far.
+func (s *uploadStore) get(id string) (*upload, int64, error) {
+	b, err := ioutil.ReadFile(s.statePath(id))
+	if os.IsNotExist(err) {
+		return nil, 0, errUploadNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var up upload
+	if err := json.Unmarshal(b, &up); err != nil {
+		return nil, 0, fmt.Errorf("parsing upload %s failed: %v", id, err)
+	}
+	if up.Response != nil {
+		return &up, up.Meta.Size, nil
+	}
+
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &up, fi.Size(), nil
+}
+
+// finish records the response of the finished upload and
+// removes its contents, which are in the store now.
+func (s *uploadStore) finish(up *upload, resp JSONResponse) error {
+	up.Response = resp
+	if err := s.save(up); err != nil {
+		return err
+	}
+	return os.Remove(s.dataPath(up.ID))
+}
+
+// remove deletes the upload.
+func (s *uploadStore) remove(id string) error {
+	if err := os.Remove(s.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.statePath(id))
+}
+
+// lock marks the upload as busy, returning false if it already is.
+func (s *uploadStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+// unlock marks the upload as no longer busy.
+func (s *uploadStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+// reap deletes the uploads older than maxAge, finished or not.
+func (s *uploadStore) reap(maxAge time.Duration) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		logrus.Warnf("listing uploads to reap failed: %v", err)
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".json")
+		if !s.lock(id) {
+			continue
+		}
+		up, _, err := s.get(id)
+		if err == nil && time.Since(up.Created) > maxAge {
+			err = s.remove(id)
+			if err == nil {
+				logrus.Infof("stale upload %q deleted", id)
+			}
+		}
+		if err != nil {
+			logrus.Warnf("reaping upload %s failed: %v", id, err)
+		}
+		s.unlock(id)
+	}
+}
+
+// uploadsHandler is the request handler for the resumable uploads.
+// POST /paste/uploads creates an upload with the same options as
+// /paste, HEAD /paste/uploads/{id} returns its offset, PATCH sends the
+// chunk starting at the offset, POST finishes it and DELETE cancels it.
+func (cmd *serverCommand) uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := cmd.authenticate(r, scopeUpload)
+	if !ok {
+		writeUnauthorized(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/paste/uploads"), "/")
+	if len(id) < 1 {
+		if r.Method != "POST" {
+			writeErrorStatus(w, http.StatusMethodNotAllowed, "not a valid endpoint")
+			return
+		}
+		cmd.createUpload(w, r, u)
+		return
+	}
+
+	if !validID(id) {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("no such upload: %s", id))
+		return
+	}
+	// only one request can change the upload at a time, asking
+	// for the offset does not need to wait
+	if r.Method != "HEAD" {
+		if !cmd.uploads.lock(id) {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("upload %s is busy", id))
+			return
+		}
+		defer cmd.uploads.unlock(id)
+	}
+
+	up, offset, err := cmd.uploads.get(id)
+	if err == errUploadNotFound || (err == nil && up.Owner != u.name) {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("no such upload: %s", id))
+		return
+	}
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("reading upload %s failed: %v", id, err))
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+
+	switch r.Method {
+	case "HEAD":
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		cmd.appendUpload(w, r, up, offset)
+	case "POST":
+		cmd.finishUpload(w, up)
+	case "DELETE":
+		if err := cmd.uploads.remove(id); err != nil {
+			writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("deleting upload %s failed: %v", id, err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrorStatus(w, http.StatusMethodNotAllowed, "not a valid endpoint")
+	}
+}
+
+// createUpload starts a resumable upload for the user.
+func (cmd *serverCommand) createUpload(w http.ResponseWriter, r *http.Request, u *user) {
+	meta, err := cmd.pasteOptions(r, u)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the contents can be sent compressed as a whole
+	encoding := r.Header.Get(uploadEncodingHeader)
+	if _, ok := contentCompression(encoding); !ok {
+		writeErrorStatus(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content encoding %q", encoding))
+		return
+	}
+
+	// refuse taken slugs before the contents are sent, the id is
+	// only reserved once the upload is finished though.
+	if len(meta.ID) > 0 {
+		_, err := cmd.store.Stat(meta.ID)
+		if err == nil {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("paste id %s is already taken", meta.ID))
+			return
+		}
+		if err != errPasteNotFound {
+			writeErrorStatus(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	id, err := uuid()
+	if err != nil {
+		writeError(w, fmt.Sprintf("uuid generation failed: %v", err))
+		return
+	}
+	up := &upload{
+		ID:       id,
+		Owner:    u.name,
+		Created:  time.Now().UTC(),
+		Expire:   r.URL.Query().Get("expire"),
+		Encoding: encoding,
+		Meta:     meta,
+	}
+	if err := cmd.uploads.create(up); err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("creating upload %s failed: %v", id, err))
+		return
+	}
+
+	uri := baseuri + "paste/uploads/" + id
+	w.Header().Set("Location", uri)
+	w.Header().Set(uploadOffsetHeader, "0")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, JSONResponse{
+		"upload": id,
+		"uri":    uri,
+	})
+	logrus.Infof("upload %q created", id)
+}
+
+// appendUpload appends the body of the request to the upload. The chunk
+// has to start at the current offset of the upload. If the body is cut
+// off what was received is kept, so the client can carry on from there.
+func (cmd *serverCommand) appendUpload(w http.ResponseWriter, r *http.Request, up *upload, offset int64) {
+	if up.Response != nil {
+		writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("upload %s is already finished", up.ID))
+		return
+	}
+	if r.Header.Get(uploadOffsetHeader) != strconv.FormatInt(offset, 10) {
+		writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("upload %s is at offset %d", up.ID, offset))
+		return
+	}
+
+	file := cmd.uploads.dataPath(up.ID)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("opening upload %s failed: %v", up.ID, err))
+		return
+	}
+	n := offset
+	body := &sizeReader{r: r.Body, max: cmd.maxSize, n: &n}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if body.tooLarge() {
+		os.Truncate(file, offset)
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+		writeErrorStatus(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("paste is larger than the maximum size of %d bytes", cmd.maxSize))
+		return
+	}
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("receiving chunk of upload %s failed: %v", up.ID, err))
+		return
+	}
+
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(n, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload stores the contents of the upload as a paste. Finishing
+// an upload again returns the same response.
+func (cmd *serverCommand) finishUpload(w http.ResponseWriter, up *upload) {
+	if up.Response != nil {
+		fmt.Fprint(w, up.Response)
+		return
+	}
+
+	// the paste expires counting from when it is finished
+	expires, err := cmd.expiresAt(up.Expire)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	meta := up.Meta
+	meta.Created = time.Now().UTC()
+	meta.Expires = expires
+
+	f, err := os.Open(cmd.uploads.dataPath(up.ID))
+	if err != nil {
+		writeErrorStatus(w, http.StatusInternalServerError, fmt.Sprintf("opening upload %s failed: %v", up.ID, err))
+		return
+	}
+	body, err := decodeBody(f, up.Encoding)
+	if err != nil {
+		f.Close()
+		writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("decoding upload %s failed: %v", up.ID, err))
+		return
+	}
+	resp, ok := cmd.storePaste(w, body, meta)
+	body.Close()
+	if !ok {
+		return
+	}
+
+	if err := cmd.uploads.finish(up, resp); err != nil {
+		logrus.Warnf("cleaning up upload %s failed: %v", up.ID, err)
+	}
+	fmt.Fprint(w, resp)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestUpload creates a resumable upload as the user
+// and returns its uri.
+func createTestUpload(t *testing.T, srv *httptest.Server, user, query string) string {
+	t.Helper()
+	resp, body := doTestRequest(t, newTestRequest(t, "POST", srv.URL+"/paste/uploads?"+query, user, nil))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating upload returned %s: %s", resp.Status, body)
+	}
+	if resp.Header.Get(uploadOffsetHeader) != "0" {
+		t.Fatalf("new upload is at offset %q, expected 0", resp.Header.Get(uploadOffsetHeader))
+	}
+	return resp.Header.Get("Location")
+}
+
+// patchTestUpload sends the chunk at the offset as the user.
+func patchTestUpload(t *testing.T, uri, user string, offset int64, chunk string) (*http.Response, string) {
+	t.Helper()
+	req := newTestRequest(t, "PATCH", uri, user, strings.NewReader(chunk))
+	req.Header.Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	return doTestRequest(t, req)
+}
+
+// testUploadOffset returns the offset of the upload from a HEAD request.
+func testUploadOffset(t *testing.T, uri, user string) int64 {
+	t.Helper()
+	resp, _ := doTestRequest(t, newTestRequest(t, "HEAD", uri, user, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("getting the offset of the upload returned %s", resp.Status)
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offset
+}
+
+func TestUpload(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	uri := createTestUpload(t, srv, "alice", "filename=notes.txt")
+
+	for _, chunk := range []string{"hello ", "resumable ", "world"} {
+		offset := testUploadOffset(t, uri, "alice")
+		resp, body := patchTestUpload(t, uri, "alice", offset, chunk)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("sending chunk %q returned %s: %s", chunk, resp.Status, body)
+		}
+		if got := resp.Header.Get(uploadOffsetHeader); got != strconv.FormatInt(offset+int64(len(chunk)), 10) {
+			t.Fatalf("upload is at offset %s after sending %q at %d", got, chunk, offset)
+		}
+	}
+	if offset := testUploadOffset(t, uri, "alice"); offset != 21 {
+		t.Fatalf("upload is at offset %d, expected 21", offset)
+	}
+
+	resp, first := doTestRequest(t, newTestRequest(t, "POST", uri, "alice", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("finishing upload returned %s: %s", resp.Status, first)
+	}
+	var r struct{ URI string }
+	if err := json.Unmarshal([]byte(first), &r); err != nil {
+		t.Fatal(err)
+	}
+	id := path.Base(r.URI)
+	if got := readPaste(t, cmd.store, id); got != "hello resumable world" {
+		t.Fatalf("paste is %q, expected hello resumable world", got)
+	}
+	meta, err := cmd.store.Stat(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Owner != "alice" || meta.Filename != "notes.txt" || meta.Size != 21 {
+		t.Fatalf("metadata is %+v, expected the options of the upload", meta)
+	}
+
+	// finishing again, like a client that did not get the response
+	resp, again := doTestRequest(t, newTestRequest(t, "POST", uri, "alice", nil))
+	if resp.StatusCode != http.StatusOK || again != first {
+		t.Fatalf("finishing upload again returned %s: %s, expected %s", resp.Status, again, first)
+	}
+	if pastes, err := cmd.store.List(); err != nil || len(pastes) != 1 {
+		t.Fatalf("%d pastes stored after finishing twice (%v), expected 1", len(pastes), err)
+	}
+
+	// and the finished upload takes no more chunks
+	if resp, body := patchTestUpload(t, uri, "alice", 21, "more"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("sending a chunk to a finished upload returned %s, expected 409: %s", resp.Status, body)
+	}
+}
+
+func TestUploadWrongOffset(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+	uri := createTestUpload(t, srv, "alice", "")
+	if resp, body := patchTestUpload(t, uri, "alice", 0, "hello"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("sending chunk returned %s: %s", resp.Status, body)
+	}
+
+	for _, offset := range []int64{0, 3, 6} {
+		resp, body := patchTestUpload(t, uri, "alice", offset, "world")
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("sending a chunk at offset %d returned %s, expected 409: %s", offset, resp.Status, body)
+		}
+		if got := resp.Header.Get(uploadOffsetHeader); got != "5" {
+			t.Fatalf("conflict has offset %q, expected 5", got)
+		}
+	}
+	if offset := testUploadOffset(t, uri, "alice"); offset != 5 {
+		t.Fatalf("upload is at offset %d after chunks at the wrong offset, expected 5", offset)
+	}
+}
+
+func TestUploadCutOff(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	uri := createTestUpload(t, srv, "alice", "")
+
+	// send half of a chunk and hang up
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newTestRequest(t, "PATCH", uri, "alice", nil)
+	fmt.Fprintf(conn, "PATCH %s HTTP/1.1\r\nHost: %s\r\nAuthorization: %s\r\n%s: 0\r\nContent-Length: 10\r\n\r\nhello",
+		u.Path, u.Host, req.Header.Get("Authorization"), uploadOffsetHeader)
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	conn.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("cut off chunk returned %s, expected 400", resp.Status)
+	}
+
+	// what was received is kept and the rest is sent from there
+	var offset int64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if offset = testUploadOffset(t, uri, "alice"); offset == 5 {
+			break
+		}
+	}
+	if offset != 5 {
+		t.Fatalf("upload is at offset %d after the chunk was cut off, expected 5", offset)
+	}
+	if resp, body := patchTestUpload(t, uri, "alice", offset, " world"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("resuming upload returned %s: %s", resp.Status, body)
+	}
+
+	resp, body := doTestRequest(t, newTestRequest(t, "POST", uri, "alice", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("finishing upload returned %s: %s", resp.Status, body)
+	}
+	pastes, err := cmd.store.List()
+	if err != nil || len(pastes) != 1 {
+		t.Fatalf("%d pastes stored (%v), expected 1", len(pastes), err)
+	}
+	if got := readPaste(t, cmd.store, pastes[0].ID); got != "hello world" {
+		t.Fatalf("paste is %q, expected hello world", got)
+	}
+}
+
+func TestUploadOtherUser(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	uri := createTestUpload(t, srv, "alice", "")
+	if resp, body := patchTestUpload(t, uri, "alice", 0, "hello"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("sending chunk returned %s: %s", resp.Status, body)
+	}
+
+	for _, method := range []string{"HEAD", "PATCH", "POST", "DELETE"} {
+		req := newTestRequest(t, method, uri, "bob", strings.NewReader("bob"))
+		req.Header.Set(uploadOffsetHeader, "5")
+		if resp, body := doTestRequest(t, req); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s of the upload of another user returned %s, expected 404: %s", method, resp.Status, body)
+		}
+	}
+	if resp, _ := doTestRequest(t, newTestRequest(t, "HEAD", uri, "", nil)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("HEAD of an upload without credentials returned %s, expected 401", resp.Status)
+	}
+
+	// nothing bob did changed it
+	if offset := testUploadOffset(t, uri, "alice"); offset != 5 {
+		t.Fatalf("upload is at offset %d, expected 5", offset)
+	}
+	if pastes, err := cmd.store.List(); err != nil || len(pastes) != 0 {
+		t.Fatalf("%d pastes stored (%v), expected none", len(pastes), err)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	cmd, srv := newTestServer(t, func(cmd *serverCommand) { cmd.maxSize = 10 })
+	uri := createTestUpload(t, srv, "alice", "")
+	if resp, body := patchTestUpload(t, uri, "alice", 0, "hello "); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("sending chunk returned %s: %s", resp.Status, body)
+	}
+
+	// the chunk going over the limit is dropped
+	resp, body := patchTestUpload(t, uri, "alice", 6, "world!")
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("sending a chunk over the limit returned %s, expected 413: %s", resp.Status, body)
+	}
+	if got := resp.Header.Get(uploadOffsetHeader); got != "6" {
+		t.Fatalf("chunk over the limit left the upload at offset %q, expected 6", got)
+	}
+	if offset := testUploadOffset(t, uri, "alice"); offset != 6 {
+		t.Fatalf("upload is at offset %d, expected 6", offset)
+	}
+
+	// and one within it can still be sent
+	if resp, body := patchTestUpload(t, uri, "alice", 6, "moon"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("sending a chunk up to the limit returned %s: %s", resp.Status, body)
+	}
+	resp, body = doTestRequest(t, newTestRequest(t, "POST", uri, "alice", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("finishing upload returned %s: %s", resp.Status, body)
+	}
+	pastes, err := cmd.store.List()
+	if err != nil || len(pastes) != 1 {
+		t.Fatalf("%d pastes stored (%v), expected 1", len(pastes), err)
+	}
+	if got := readPaste(t, cmd.store, pastes[0].ID); got != "hello moon" {
+		t.Fatalf("paste is %q, expected hello moon", got)
+	}
+}
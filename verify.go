@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// verify reads all the pastes and blobs in the store, checking them
+// against their checksums, and fails if any of them are corrupted.
+func (cmd *serverCommand) verify() error {
+	var s *checksumStore
+	for _, st := range unwrapStore(cmd.store) {
+		if cs, ok := st.(*checksumStore); ok {
+			s = cs
+		}
+	}
+	if s == nil {
+		return errors.New("verify needs a store with checksums")
+	}
+
+	// list below the deduplication so the blobs are checked too, and
+	// below the encryption so no keys are needed.
+	pastes, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	var checked, unchecked, corrupted int
+	for _, p := range pastes {
+		if len(p.SHA256) < 1 {
+			unchecked++
+			continue
+		}
+		if err := verifyPaste(s, p.ID); err != nil {
+			logrus.Error(err)
+			corrupted++
+			continue
+		}
+		checked++
+	}
+
+	logrus.Infof("verified %d pastes and blobs, %d without checksums", checked, unchecked)
+	if corrupted > 0 {
+		return fmt.Errorf("%d pastes are corrupted", corrupted)
+	}
+	return nil
+}
+
+// verifyPaste reads the paste through the checksumStore.
+func verifyPaste(s *checksumStore, id string) error {
+	rc, _, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		return fmt.Errorf("reading paste %s failed: %v", id, err)
+	}
+	return nil
+}
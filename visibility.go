@@ -0,0 +1,51 @@
+package main
+
+import "net/http"
+
+const (
+	// visibilityPublic pastes can be read by anyone and are listed
+	// in the index. Pastes without a visibility are public.
+	visibilityPublic = "public"
+	// visibilityUnlisted pastes can be read by anyone with the link
+	// but are not listed in the public index.
+	visibilityUnlisted = "unlisted"
+	// visibilityPrivate pastes can only be read by their owner.
+	visibilityPrivate = "private"
+)
+
+// validVisibility returns whether v is a known visibility.
+func validVisibility(v string) bool {
+	return v == visibilityPublic || v == visibilityUnlisted || v == visibilityPrivate
+}
+
+// canRead returns whether the user can read the paste.
+// A nil user is anonymous.
+func (u *user) canRead(meta *Metadata) bool {
+	if meta.Visibility != visibilityPrivate {
+		return true
+	}
+	return u != nil && (u.admin || meta.Owner == u.name)
+}
+
+// authorizeRead makes sure the requester can read the paste, writing
+// the error response and returning false if they cannot.
+func (cmd *serverCommand) authorizeRead(w http.ResponseWriter, r *http.Request, meta *Metadata) bool {
+	if meta.Visibility != visibilityPrivate {
+		return true
+	}
+
+	u, ok := cmd.authenticate(r, scopeReadPrivate)
+	if !ok {
+		writeUnauthorized(w)
+		return false
+	}
+	if !u.canRead(meta) {
+		// do not give away that the paste exists
+		writeErrorStatus(w, http.StatusNotFound, "No such file or directory: "+r.URL.Path)
+		return false
+	}
+
+	// keep private pastes out of shared caches
+	w.Header().Set("Cache-Control", "private")
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVisibility(t *testing.T) {
+	_, srv := newTestServer(t, func(cmd *serverCommand) { cmd.authMode = authModeWrites })
+	pastes := map[string]string{}
+	for _, v := range []string{visibilityPublic, visibilityUnlisted, visibilityPrivate} {
+		pastes[v] = postTestPaste(t, srv, "alice", "visibility="+v, v+" paste")
+	}
+
+	for _, tc := range []struct {
+		user   string
+		listed []string
+		read   map[string]int
+	}{
+		{"", []string{visibilityPublic}, map[string]int{
+			visibilityPublic:   http.StatusOK,
+			visibilityUnlisted: http.StatusOK,
+			visibilityPrivate:  http.StatusUnauthorized,
+		}},
+		{"bob", nil, map[string]int{
+			visibilityPublic:   http.StatusOK,
+			visibilityUnlisted: http.StatusOK,
+			visibilityPrivate:  http.StatusNotFound,
+		}},
+		{"alice", []string{visibilityPublic, visibilityUnlisted, visibilityPrivate}, map[string]int{
+			visibilityPublic:   http.StatusOK,
+			visibilityUnlisted: http.StatusOK,
+			visibilityPrivate:  http.StatusOK,
+		}},
+		{"admin", []string{visibilityPublic, visibilityUnlisted, visibilityPrivate}, map[string]int{
+			visibilityPublic:   http.StatusOK,
+			visibilityUnlisted: http.StatusOK,
+			visibilityPrivate:  http.StatusOK,
+		}},
+	} {
+		t.Run("user "+tc.user, func(t *testing.T) {
+			resp, index := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/", tc.user, nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("getting the index returned %s: %s", resp.Status, index)
+			}
+			for v, id := range pastes {
+				expected := false
+				for _, l := range tc.listed {
+					expected = expected || l == v
+				}
+				if strings.Contains(index, id) != expected {
+					t.Fatalf("index lists the %s paste: %v, expected %v:\n%s", v, !expected, expected, index)
+				}
+			}
+
+			for v, status := range tc.read {
+				for _, view := range []string{"", "/raw"} {
+					resp, body := doTestRequest(t, newTestRequest(t, "GET", srv.URL+"/"+pastes[v]+view, tc.user, nil))
+					if resp.StatusCode != status {
+						t.Fatalf("getting the %s paste%s returned %s, expected %d: %s", v, view, resp.Status, status, body)
+					}
+					if status != http.StatusOK {
+						continue
+					}
+					if view == "/raw" && body != v+" paste" {
+						t.Fatalf("%s paste is %q, expected %q", v, body, v+" paste")
+					}
+					if v == visibilityPrivate && resp.Header.Get("Cache-Control") != "private" {
+						t.Fatalf("private paste is served with Cache-Control %q, expected private", resp.Header.Get("Cache-Control"))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateVisibility(t *testing.T) {
+	cmd, srv := newTestServer(t, nil)
+	id := postTestPaste(t, srv, "alice", "visibility=private", "private paste")
+	patch := func(user, body string) int {
+		req := newTestRequest(t, "PATCH", srv.URL+"/api/pastes/"+id, user, strings.NewReader(body))
+		resp, _ := doTestRequest(t, req)
+		return resp.StatusCode
+	}
+	visibility := func() string {
+		meta, err := cmd.store.Stat(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.Visibility
+	}
+
+	// other users do not get to know the paste exists
+	if status := patch("bob", `{"visibility":"public"}`); status != http.StatusNotFound {
+		t.Fatalf("updating the paste of another user returned %d, expected 404", status)
+	}
+	if status := patch("", `{"visibility":"public"}`); status != http.StatusUnauthorized {
+		t.Fatalf("updating a paste without credentials returned %d, expected 401", status)
+	}
+	if status := patch("alice", `{"visibility":"secret"}`); status != http.StatusBadRequest {
+		t.Fatalf("updating a paste to an unknown visibility returned %d, expected 400", status)
+	}
+	if v := visibility(); v != visibilityPrivate {
+		t.Fatalf("paste is %s after refused updates, expected private", v)
+	}
+
+	for _, tc := range []struct {
+		user       string
+		visibility string
+	}{
+		{"alice", visibilityUnlisted},
+		{"admin", visibilityPublic},
+		{"alice", visibilityPrivate},
+	} {
+		if status := patch(tc.user, `{"visibility":"`+tc.visibility+`"}`); status != http.StatusOK {
+			t.Fatalf("updating the paste to %s as %s returned %d", tc.visibility, tc.user, status)
+		}
+		if v := visibility(); v != tc.visibility {
+			t.Fatalf("paste is %s after updating it to %s", v, tc.visibility)
+		}
+	}
+}